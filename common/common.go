@@ -1,6 +1,8 @@
 package common
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"os"
 	"strings"
 	"time"
@@ -62,6 +64,32 @@ func GetBootFile() string {
 	return "/etc/boot-time"
 }
 
+// WriteBootFile records the start of a new boot: the boot time on the first line and a new random boot ID on the second
+func WriteBootFile(bootTime time.Time) error {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return os.WriteFile(GetBootFile(), []byte(bootTime.Format(time.RFC3339)+"\n"+hex.EncodeToString(id)+"\n"), 0644)
+}
+
+// ReadBootFile returns the time and ID of the current boot; the ID is empty for boot files written by older versions
+func ReadBootFile() (bootTime time.Time, bootID string, err error) {
+	contents, err := os.ReadFile(GetBootFile())
+	if err != nil {
+		return bootTime, "", err
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	bootTime, err = time.Parse(time.RFC3339, strings.TrimSpace(lines[0]))
+	if len(lines) > 1 {
+		bootID = strings.TrimSpace(lines[1])
+	}
+	return bootTime, bootID, err
+}
+
+// BootMarker is the line written to unit logs when a unit first logs during a boot, used by journalctl -b
+func BootMarker(bootID string) string {
+	return "-- Boot " + bootID + " --"
+}
+
 func LogTimeFormat() string {
 	return time.DateTime
 }
@@ -7,7 +7,6 @@ require (
 	github.com/jessevdk/go-flags v1.6.1
 	github.com/mattn/go-isatty v0.0.20
 	github.com/mitchellh/go-ps v1.0.0
-	gopkg.in/yaml.v3 v3.0.1
 )
 
 require golang.org/x/sys v0.22.0 // indirect
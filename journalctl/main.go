@@ -3,12 +3,15 @@ package journalctl
 import (
 	"bufio"
 	"docker-systemd/common"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	flags "github.com/jessevdk/go-flags"
@@ -25,6 +28,7 @@ type opts struct {
 	Lines   int    `short:"n" long:"lines" description:"show max X last lines"`
 	Follow  bool   `short:"f" long:"follow" description:"follow log; implies lines"`
 	NoPager bool   `long:"no-pager" description:"do not page results; implied with follow" hidden:"true"`
+	Output  string `short:"o" long:"output" description:"output mode" choice:"short" choice:"cat" choice:"json" choice:"json-pretty" default:"short"`
 	Help    bool   `short:"h" long:"help" description:"display help"`
 }
 
@@ -63,60 +67,90 @@ func Main() {
 		}
 	}
 
+	bootMarker := ""
 	if opt.Boot {
-		bootTimeString, err := os.ReadFile(common.GetBootFile())
-		if err == nil {
-			bootTime, err := time.Parse(time.RFC3339, string(bootTimeString))
-			if err == nil && !bootTime.IsZero() {
-				if opt.since.IsZero() || bootTime.After(opt.since) {
-					opt.since = bootTime
-				}
+		bootTime, bootID, err := common.ReadBootFile()
+		if err == nil && bootID != "" {
+			// only print the lines following the marker of the current boot
+			bootMarker = common.BootMarker(bootID)
+		} else if err == nil && !bootTime.IsZero() {
+			if opt.since.IsZero() || bootTime.After(opt.since) {
+				opt.since = bootTime
 			}
 		}
 	}
 
+	f, err := os.Open(logFile)
+	if err != nil {
+		log.Fatalf("ERR Cannot open log file %s for reading: %s", logFile, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatalf("ERR Cannot read log file %s: %s", logFile, err)
+	}
+
 	if opt.Follow {
 		if opt.Lines == 0 {
 			opt.Lines = 10
 		}
-		cmd := exec.Command("tail", "-n", strconv.Itoa(opt.Lines), "-f", logFile)
+		// the last lines are selected like without --follow, tail then continues right after them
+		bootID := opt.scan(io.LimitReader(f, fi.Size()), bootMarker)
+		cmd := exec.Command("tail", "-c", "+"+strconv.FormatInt(fi.Size()+1, 10), "-f", logFile)
 		cmd.Stderr = os.Stderr
 		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		err = cmd.Run()
-		if err != nil {
-			os.Exit(1)
+		if opt.isJSON() {
+			// the lines are converted as tail prints them
+			var out io.ReadCloser
+			out, err = cmd.StdoutPipe()
+			if err == nil {
+				err = cmd.Start()
+			}
+			if err != nil {
+				os.Exit(1)
+			}
+			s := bufio.NewScanner(out)
+			for s.Scan() {
+				bootID = opt.printLine(s.Text(), bootID)
+			}
+			err = cmd.Wait()
+		} else {
+			cmd.Stdout = os.Stdout
+			err = cmd.Run()
 		}
-		return
-	}
-
-	if opt.Lines > 0 {
-		cmd := exec.Command("tail", "-n", strconv.Itoa(opt.Lines))
-		cmd.Stderr = os.Stderr
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		err = cmd.Run()
 		if err != nil {
 			os.Exit(1)
 		}
 		return
 	}
 
-	f, err := os.Open(logFile)
-	if err != nil {
-		log.Fatalf("ERR Cannot open log file %s for reading: %s", logFile, err)
-	}
-	defer f.Close()
-
 	if !opt.NoPager {
 		p := &pager{}
 		p.Page()
 		defer p.Close()
 	}
-	s := bufio.NewScanner(f)
+	opt.scan(f, bootMarker)
+}
+
+// scan prints the log lines matching --since, --until and --boot, or the last --lines of them; the boot marker, if
+// given, is the one of the current boot and the lines before it are skipped. Returns the boot ID of the last line
+func (opt *opts) scan(r io.Reader, bootMarker string) string {
+	type entry struct{ line, bootID string }
+	s := bufio.NewScanner(r)
+	inBoot := bootMarker == ""
+	bootID := ""
+	last := []entry{}
 	for s.Scan() {
 		line := s.Text()
-		if !opt.since.IsZero() && !opt.until.IsZero() {
+		if bootMarker != "" && line == bootMarker {
+			inBoot = true
+			bootID = strings.TrimSuffix(strings.TrimPrefix(line, "-- Boot "), " --")
+			continue
+		}
+		if !inBoot {
+			continue
+		}
+		if !opt.since.IsZero() || !opt.until.IsZero() {
 			if len(line) < 19 {
 				continue
 			}
@@ -128,11 +162,63 @@ func Main() {
 				continue
 			}
 			if !opt.until.IsZero() && ts.After(opt.until) {
-				return
+				break
+			}
+		}
+		if opt.Lines > 0 {
+			// with --lines only the last lines are kept, with the boot ID they belong to
+			if strings.HasPrefix(line, "-- Boot ") && strings.HasSuffix(line, " --") {
+				bootID = strings.TrimSuffix(strings.TrimPrefix(line, "-- Boot "), " --")
+				continue
+			}
+			last = append(last, entry{line, bootID})
+			if len(last) > opt.Lines {
+				last = last[1:]
 			}
+			continue
 		}
+		bootID = opt.printLine(line, bootID)
+	}
+	for _, e := range last {
+		opt.printLine(e.line, e.bootID)
+	}
+	return bootID
+}
+
+// isJSON returns true for the json output modes
+func (opt *opts) isJSON() bool {
+	return opt.Output == "json" || opt.Output == "json-pretty"
+}
+
+// printLine prints a log line in the output mode and returns the boot ID the following lines belong to; in the json
+// modes boot markers are not printed, they only set the _BOOT_ID of the entries after them
+func (opt *opts) printLine(line string, bootID string) string {
+	if strings.HasPrefix(line, "-- Boot ") && strings.HasSuffix(line, " --") {
+		bootID = strings.TrimSuffix(strings.TrimPrefix(line, "-- Boot "), " --")
+		if opt.isJSON() {
+			return bootID
+		}
+	}
+	if !opt.isJSON() {
 		fmt.Println(line)
+		return bootID
+	}
+	unit := opt.Unit
+	if !strings.Contains(unit, ".") {
+		unit += ".service"
+	}
+	entry := map[string]string{"_SYSTEMD_UNIT": unit, "MESSAGE": line}
+	if bootID != "" {
+		entry["_BOOT_ID"] = bootID
+	}
+	var out []byte
+	if opt.Output == "json-pretty" {
+		out, _ = json.MarshalIndent(entry, "", "\t")
+	} else {
+		out, _ = json.Marshal(entry)
 	}
+	fmt.Println(string(out))
+	return bootID
 }
 
 type pager struct {
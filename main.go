@@ -39,6 +39,8 @@ func main() {
 		systemctl.Main([]string{os.Args[0], "poweroff"})
 	case "shutdown":
 		systemctl.Main([]string{os.Args[0], "poweroff"})
+	case "reboot":
+		systemctl.Main([]string{os.Args[0], "reboot"})
 	case "service":
 		args := os.Args
 		if len(args) > 2 {
@@ -48,10 +50,11 @@ func main() {
 		}
 		systemctl.Main(args)
 	default:
-		startTime := time.Now().Format(time.RFC3339)
-		log.Printf("INIT: Booting <%s>", startTime)
+		startTime := time.Now()
+		log.Printf("INIT: Booting <%s>", startTime.Format(time.RFC3339))
 		install()
-		os.WriteFile(common.GetBootFile(), []byte(startTime), 0644)
+		common.WriteBootFile(startTime)
+		systemd.Version = strings.Trim(version, "\r\n\t ")
 		systemd.Main()
 	}
 }
@@ -70,7 +73,7 @@ func install() {
 			break
 		}
 	}
-	for _, f := range []string{"/journalctl", "/systemctl", "/systemd", "/init", "/poweroff", "/shutdown", "/service"} {
+	for _, f := range []string{"/journalctl", "/systemctl", "/systemd", "/init", "/poweroff", "/shutdown", "/reboot", "/service"} {
 		f = basePath + f
 		if me == f {
 			continue
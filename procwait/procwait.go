@@ -35,14 +35,29 @@ func Is(pid int) bool {
 
 // replaces cmd.Run()
 func Run(cmd *exec.Cmd) (*syscall.WaitStatus, error) {
+	err := Start(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return Finish(cmd)
+}
+
+// Start starts the command and registers it with the reaper; cmd.Process may be read once it returns, and Finish
+// waits for the command
+func Start(cmd *exec.Cmd) error {
 	waits.Lock()
+	defer waits.Unlock()
 	waits.run[cmd] = &proc{}
 	waits.run[cmd].Lock()
-	waits.Unlock()
 	err := cmd.Start()
 	if err != nil {
-		return nil, err
+		delete(waits.run, cmd)
 	}
+	return err
+}
+
+// Finish waits for a command started with Start, returning an error unless it exited with status 0
+func Finish(cmd *exec.Cmd) (*syscall.WaitStatus, error) {
 	ws, err := waitCmd(cmd)
 	if err != nil {
 		return ws, err
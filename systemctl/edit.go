@@ -0,0 +1,205 @@
+package systemctl
+
+import (
+	"bytes"
+	"docker-systemd/systemd"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+const (
+	editHeader = "### Editing %s\n### Anything between here and the comment below will become the contents of the drop-in file\n\n"
+	editMarker = "### Edits below this comment will be discarded"
+)
+
+// edit is resolved client-side, as the editor needs the terminal of systemctl: the drop-in, or with --full the unit
+// file, is copied to a temporary file next to it, edited and moved into place; the manager then reloads and validates
+// the units. Returns the arguments to send to the manager, or exits if there is nothing to reload
+func edit(args []string) []string {
+	if len(args) < 2 {
+		return args
+	}
+	options, positional := systemd.SplitArgs(args[1:])
+	if len(positional) == 0 || positional[0] != "edit" {
+		return args
+	}
+	units := positional[1:]
+	full, force, dropIn := false, false, "override"
+	for i := 0; i < len(options); i++ {
+		switch option := options[i]; {
+		case option == "--full" || option == "-l":
+			full = true
+		case option == "--force":
+			force = true
+		case option == "--drop-in" && i+1 < len(options):
+			i++
+			dropIn = options[i]
+		case strings.HasPrefix(option, "--drop-in="):
+			dropIn = strings.TrimPrefix(option, "--drop-in=")
+		}
+	}
+	if len(units) == 0 {
+		log.Fatal("No units specified.")
+	}
+	dropIn = strings.TrimSuffix(dropIn, ".conf") + ".conf"
+	changed := false
+	for _, unit := range units {
+		if !strings.Contains(unit, ".") {
+			unit += ".service"
+		}
+		loadState := queryProperty(args[0], unit, "LoadState")
+		fragment := queryProperty(args[0], unit, "FragmentPath")
+		switch {
+		case loadState == "masked":
+			log.Fatalf("Cannot edit %s: unit is masked.", unit)
+		case (loadState == "not-found" || fragment == "") && !force:
+			log.Fatalf("Unit %s not found.\nRun 'systemctl edit --force --full %s' to create a new unit.", unit, unit)
+		}
+		target := path.Join("/etc/systemd/system", unit+".d", dropIn)
+		if full {
+			target = path.Join("/etc/systemd/system", unit)
+		}
+		if editFile(target, fragment, full) {
+			changed = true
+		}
+	}
+	if !changed {
+		os.Exit(0)
+	}
+	return args
+}
+
+// editFile runs the editor on a temporary copy of the file and moves it into place; a new drop-in starts with the unit
+// file commented out below the marker, a new unit file with the contents of the vendor unit file. Returns true if the
+// file was written
+func editFile(target string, fragment string, full bool) bool {
+	original, err := os.ReadFile(target)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Failed to read %s: %s", target, err)
+	}
+	contents := original
+	if full && err != nil && fragment != "" {
+		if contents, err = os.ReadFile(fragment); err != nil {
+			log.Fatalf("Failed to read %s: %s", fragment, err)
+		}
+	}
+	if !full {
+		b := &bytes.Buffer{}
+		b.WriteString(fmt.Sprintf(editHeader, target))
+		b.Write(original)
+		b.WriteString("\n" + editMarker + "\n")
+		if fragment != "" {
+			if vendor, err := os.ReadFile(fragment); err == nil {
+				b.WriteString("\n### " + fragment + "\n")
+				for _, line := range strings.Split(strings.TrimRight(string(vendor), "\n"), "\n") {
+					b.WriteString(strings.TrimRight("# "+line, " ") + "\n")
+				}
+			}
+		}
+		contents = b.Bytes()
+	}
+	dir := path.Dir(target)
+	_, dirErr := os.Stat(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("Failed to create %s: %s", dir, err)
+	}
+	tmp, err := os.CreateTemp(dir, ".#"+path.Base(target))
+	if err != nil {
+		log.Fatalf("Failed to create temporary file for %s: %s", target, err)
+	}
+	tmp.Write(contents)
+	tmp.Close()
+	cleanup := func() {
+		os.Remove(tmp.Name())
+		if dirErr != nil {
+			// the drop-in directory was created for this edit
+			os.Remove(dir)
+		}
+	}
+	if err := runEditor(tmp.Name()); err != nil {
+		cleanup()
+		log.Fatalf("Editor failed: %s", err)
+	}
+	edited, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		cleanup()
+		log.Fatalf("Failed to read %s: %s", tmp.Name(), err)
+	}
+	if !full {
+		edited = stripEditComments(edited)
+	}
+	if len(bytes.TrimSpace(edited)) == 0 {
+		cleanup()
+		log.Printf("Editing \"%s\" canceled: temporary file is empty.", target)
+		return false
+	}
+	if bytes.Equal(edited, original) || (full && bytes.Equal(edited, contents)) {
+		cleanup()
+		return false
+	}
+	if err := os.WriteFile(tmp.Name(), edited, 0644); err == nil {
+		err = os.Rename(tmp.Name(), target)
+	}
+	if err != nil {
+		cleanup()
+		log.Fatalf("Failed to write %s: %s", target, err)
+	}
+	os.Chmod(target, 0644)
+	return true
+}
+
+// stripEditComments removes the ### header lines of a drop-in and everything from the marker on
+func stripEditComments(contents []byte) []byte {
+	s := string(contents)
+	if i := strings.Index(s, editMarker); i >= 0 {
+		s = s[:i]
+	}
+	lines := []string{}
+	for _, line := range strings.Split(s, "\n") {
+		if !strings.HasPrefix(line, "### ") {
+			lines = append(lines, line)
+		}
+	}
+	s = strings.TrimSpace(strings.Join(lines, "\n"))
+	if s == "" {
+		return nil
+	}
+	return []byte(s + "\n")
+}
+
+// runEditor runs $SYSTEMD_EDITOR, $EDITOR or $VISUAL, or else the first of editor, nano, vim and vi found, on the file
+func runEditor(file string) error {
+	command := []string{}
+	for _, env := range []string{"SYSTEMD_EDITOR", "EDITOR", "VISUAL"} {
+		if command = strings.Fields(os.Getenv(env)); len(command) > 0 {
+			break
+		}
+	}
+	if len(command) == 0 {
+		for _, editor := range []string{"editor", "nano", "vim", "vi"} {
+			if _, err := exec.LookPath(editor); err == nil {
+				command = []string{editor}
+				break
+			}
+		}
+	}
+	if len(command) == 0 {
+		log.Fatal("Cannot edit files, no editor available. Set $SYSTEMD_EDITOR, $EDITOR or $VISUAL.")
+	}
+	cmd := exec.Command(command[0], append(command[1:], file)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// queryProperty asks the manager for a property of the unit
+func queryProperty(arg0 string, unit string, property string) string {
+	out := &bytes.Buffer{}
+	request([]string{arg0, "show", "--value", "-p", property, unit}, out)
+	return strings.TrimSpace(out.String())
+}
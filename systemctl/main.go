@@ -3,11 +3,17 @@ package systemctl
 import (
 	"bytes"
 	"docker-systemd/common"
+	"docker-systemd/systemd"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
 )
 
 /* send buffer is:
@@ -24,6 +30,15 @@ magic 5-byte signature and 16-bit int: return value
 */
 
 func Main(args []string) {
+	args = importEnvironment(args)
+	args = edit(args)
+	args = colorOption(args)
+	args = columnsOption(args)
+	os.Exit(request(args, os.Stdout))
+}
+
+// request sends the arguments to the manager, writes the response to out and returns the exit code
+func request(args []string, out io.Writer) int {
 	conn, err := net.Dial("unix", common.SocketPath())
 	if err != nil {
 		log.Fatal(err)
@@ -54,7 +69,7 @@ func Main(args []string) {
 		}
 		if !isEnd && bytes.HasSuffix(recvBuf[0:recvSize], []byte{0x00}) {
 			if recvSize > 1 {
-				fmt.Print(string(recvBuf[0 : recvSize-1]))
+				fmt.Fprint(out, string(recvBuf[0:recvSize-1]))
 			}
 			_, err = conn.Write([]byte{0x00})
 			if err != nil {
@@ -65,10 +80,86 @@ func Main(args []string) {
 		}
 		if isEnd {
 			if recvSize >= 5 && recvSize <= 7 && bytes.Equal(recvBuf[0:5], common.SystemctlExitCodeMagic) {
-				os.Exit(int(binary.LittleEndian.Uint16(recvBuf[recvSize-2 : recvSize])))
+				return int(binary.LittleEndian.Uint16(recvBuf[recvSize-2 : recvSize]))
 			}
 			log.Fatalf("Received extra bytes at end of message: %v", recvBuf[0:recvSize])
 		}
-		fmt.Print(string(recvBuf[0:recvSize]))
+		fmt.Fprint(out, string(recvBuf[0:recvSize]))
+	}
+}
+
+// colorOption asks the manager for coloured output when writing to a terminal, unless disabled by $NO_COLOR or
+// $SYSTEMD_COLORS
+func colorOption(args []string) []string {
+	if len(args) == 0 || os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return args
+	}
+	switch strings.ToLower(os.Getenv("SYSTEMD_COLORS")) {
+	case "0", "no", "false", "off":
+		return args
+	}
+	if fi, err := os.Stdout.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return args
+	}
+	return append([]string{args[0], "--color"}, args[1:]...)
+}
+
+// columnsOption tells the manager the width of the terminal, from $COLUMNS or the terminal itself, so that status
+// can ellipsize long lines
+func columnsOption(args []string) []string {
+	if len(args) == 0 {
+		return args
+	}
+	columns, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || columns <= 0 {
+		var ws struct{ row, col, xpixel, ypixel uint16 }
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdout.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
+		if errno != 0 || ws.col == 0 {
+			return args
+		}
+		columns = int(ws.col)
+	}
+	return append([]string{args[0], "--columns=" + strconv.Itoa(columns)}, args[1:]...)
+}
+
+// import-environment is resolved client-side: the named variables (or the whole environment if none are named)
+// are sent to the manager as VARIABLE=VALUE pairs
+func importEnvironment(args []string) []string {
+	if len(args) < 2 {
+		return args
+	}
+	options, positional := systemd.SplitArgs(args[1:])
+	if len(positional) == 0 || positional[0] != "import-environment" {
+		return args
+	}
+	nargs := append(append([]string{args[0]}, options...), positional[0])
+	if len(positional) == 1 {
+		for _, kv := range os.Environ() {
+			if name, _, _ := strings.Cut(kv, "="); isValidEnvName(name) {
+				nargs = append(nargs, kv)
+			}
+		}
+		return nargs
+	}
+	for _, name := range positional[1:] {
+		if v, ok := os.LookupEnv(name); ok {
+			nargs = append(nargs, name+"="+v)
+		} else {
+			log.Printf("Environment variable %s not set, ignoring.", name)
+		}
+	}
+	return nargs
+}
+
+func isValidEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9') {
+			continue
+		}
+		return false
 	}
+	return true
 }
@@ -2,43 +2,101 @@ package systemd
 
 import (
 	"bytes"
+	"docker-systemd/common"
 	"docker-systemd/systemd/daemons"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"path"
 	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
+	"unicode/utf8"
 
+	"github.com/bestmethod/inslice"
 	"github.com/jessevdk/go-flags"
 )
 
 type cmd struct {
-	Poweroff         cmdPoweroff         `command:"poweroff" description:"shutdown the system"`
-	Enable           cmdEnable           `command:"enable" description:"enable services" subcommands-optional:"true"`
-	Disable          cmdDisable          `command:"disable" description:"disable services"`
-	DaemonReload     cmdDaemonReload     `command:"daemon-reload" description:"reload unit files"`
-	Start            cmdStart            `command:"start" description:"start a service"`
-	Stop             cmdStop             `command:"stop" description:"stop a service"`
-	Restart          cmdRestart          `command:"restart" description:"restart a service"`
-	Reload           cmdReload           `command:"reload" description:"reload a service (send SIGHUP)"`
-	Status           cmdStatus           `command:"status" description:"status of a service"`
-	Mask             cmdMask             `command:"mask" description:"mask a service"`
-	Unmask           cmdUnmask           `command:"unmask" description:"unmask a service"`
-	Show             cmdShow             `command:"show" description:"show details of a service"`
-	CreateInstance   cmdCreateInstance   `command:"create-instance" description:"create a new instance (for multi-instance services)"`
-	DeleteInstance   cmdDeleteInstance   `command:"delete-instance" description:"delete an instance (for multi-instance services)"`
-	SetEnvironment   cmdSetEnvironment   `command:"set-environment" description:"set an environment variable on systemd process"`
-	UnsetEnvironment cmdUnsetEnvironment `command:"unset-environment" description:"unset an environment variable on systemd process"`
-	List             cmdList             `command:"list" description:"list services"`
+	Opts              globalOptions        `group:"Options"`
+	Poweroff          cmdPoweroff          `command:"poweroff" description:"shutdown the system"`
+	Reboot            cmdReboot            `command:"reboot" description:"stop all services and start them again (soft-reboot)"`
+	SoftReboot        cmdSoftReboot        `command:"soft-reboot" description:"stop all services and start them again"`
+	Enable            cmdEnable            `command:"enable" description:"enable services" subcommands-optional:"true"`
+	Disable           cmdDisable           `command:"disable" description:"disable services"`
+	DaemonReload      cmdDaemonReload      `command:"daemon-reload" description:"reload unit files"`
+	Start             cmdStart             `command:"start" description:"start a service"`
+	Stop              cmdStop              `command:"stop" description:"stop a service"`
+	Restart           cmdRestart           `command:"restart" description:"restart a service"`
+	Reload            cmdReload            `command:"reload" description:"reload a service (send SIGHUP)"`
+	Kill              cmdKill              `command:"kill" description:"send a signal to the processes of services"`
+	Status            cmdStatus            `command:"status" description:"status of a service"`
+	Mask              cmdMask              `command:"mask" description:"mask a service"`
+	Unmask            cmdUnmask            `command:"unmask" description:"unmask a service"`
+	Show              cmdShow              `command:"show" description:"show properties of units, or of the manager if no unit is given"`
+	CreateInstance    cmdCreateInstance    `command:"create-instance" description:"create a new instance (for multi-instance services)"`
+	DeleteInstance    cmdDeleteInstance    `command:"delete-instance" description:"delete an instance (for multi-instance services)"`
+	SetEnvironment    cmdSetEnvironment    `command:"set-environment" description:"set manager environment variables for started services"`
+	UnsetEnvironment  cmdUnsetEnvironment  `command:"unset-environment" description:"unset manager environment variables for started services"`
+	ShowEnvironment   cmdShowEnvironment   `command:"show-environment" description:"show the manager environment"`
+	ImportEnvironment cmdImportEnvironment `command:"import-environment" description:"import variables from the systemctl client environment into the manager environment"`
+	List              cmdList              `command:"list" description:"list services"`
+	ListUnits         cmdListUnits         `command:"list-units" description:"list units, by default the active and failed ones"`
+	ListUnitFiles     cmdListUnitFiles     `command:"list-unit-files" description:"list unit files with their enablement state and vendor preset"`
+	IsEnabled         cmdIsEnabled         `command:"is-enabled" description:"check whether unit files are enabled"`
+	IsActive          cmdIsActive          `command:"is-active" description:"check whether units are active"`
+	ResetFailed       cmdResetFailed       `command:"reset-failed" description:"reset the failed state of units, or of all units if none are given"`
+	IsFailed          cmdIsFailed          `command:"is-failed" description:"check whether units are failed"`
+	ListJobs          cmdListJobs          `command:"list-jobs" description:"list queued and running jobs"`
+	ListTimers        cmdListTimers        `command:"list-timers" description:"list timer units (timer units are not supported, the list is always empty)"`
+	ListDependencies  cmdListDependencies  `command:"list-dependencies" description:"show the dependency tree of units, by default of multi-user.target"`
+	Cancel            cmdCancel            `command:"cancel" description:"cancel jobs by ID, or all jobs if none are given"`
+	Cat               cmdCat               `command:"cat" description:"show the unit files and drop-ins of units"`
+	Edit              cmdEdit              `command:"edit" description:"edit a drop-in, or with --full the whole unit file, in $SYSTEMD_EDITOR or $EDITOR and reload"`
+	Revert            cmdRevert            `command:"revert" description:"remove the drop-ins, masks and local copies of the unit files of units"`
+	AddWants          cmdAddWants          `command:"add-wants" description:"add Wants= dependencies from a target or unit to units"`
+	AddRequires       cmdAddRequires       `command:"add-requires" description:"add Requires= dependencies from a target or unit to units"`
+}
+
+// globalOptions may be given before or after the command name
+type globalOptions struct {
+	NoBlock       bool     `long:"no-block" description:"do not wait for queued jobs to finish"`
+	JobMode       string   `long:"job-mode" default:"replace" description:"how to deal with already queued jobs: replace, fail, isolate, ignore-dependencies, ignore-requirements"`
+	Failed        bool     `long:"failed" description:"list failed units, same as list-units --state=failed"`
+	All           bool     `short:"a" long:"all" description:"list all units, including inactive ones, or show all properties, including empty ones"`
+	State         []string `long:"state" description:"only list units in these load, active or sub states, or unit files in these enablement states (comma-separated)"`
+	Type          []string `short:"t" long:"type" description:"only list units of these types (comma-separated)"`
+	Plain         bool     `long:"plain" description:"do not print the status marker column"`
+	NoLegend      bool     `long:"no-legend" description:"do not print the column headers and the footer"`
+	NoPager       bool     `long:"no-pager" description:"do not pipe output into a pager (there is no pager)"`
+	Color         bool     `long:"color" hidden:"true" description:"colour the output, set by systemctl when writing to a terminal"`
+	Lines         int      `short:"n" long:"lines" default:"10" description:"number of log lines to show in status"`
+	Full          bool     `short:"l" long:"full" description:"do not ellipsize process tree and log lines in status, or edit the whole unit file"`
+	Columns       int      `long:"columns" hidden:"true" description:"width of the terminal, set by systemctl when writing to a terminal"`
+	Property      []string `short:"p" long:"property" description:"only show these properties in show (comma-separated)"`
+	PropertyValue []string `short:"P" description:"same as --property with --value"`
+	Value         bool     `long:"value" description:"only print the values of properties in show"`
+	Output        string   `short:"o" long:"output" default:"short" choice:"short" choice:"json" choice:"json-pretty" description:"output format of list-units, list-unit-files, list-jobs, list-timers, list-dependencies, status and show"`
+	Reverse       bool     `long:"reverse" description:"list-dependencies shows the units depending on the unit"`
+	Before        bool     `long:"before" description:"list-dependencies shows the units ordered after the unit"`
+	After         bool     `long:"after" description:"list-dependencies shows the units ordered before the unit"`
+	Quiet         bool     `short:"q" long:"quiet" description:"do not print the state for is-active, is-enabled and is-failed, only set the exit code"`
+	Signal        string   `short:"s" long:"signal" default:"SIGTERM" description:"signal to send with kill, by name or number"`
+	KillWhom      string   `long:"kill-whom" default:"all" choice:"main" choice:"control" choice:"all" description:"processes to send the signal to with kill"`
 }
 
 type cmdPoweroff struct{}
+type cmdReboot struct{}
+type cmdSoftReboot struct{}
 type cmdEnable struct {
 	Now  bool `long:"now" description:"Start services after enabling"`
 	Conn *NetConn
+	Opts *globalOptions `no-flag:"true"`
 }
 type cmdDisable struct {
 	Conn *NetConn
@@ -46,33 +104,91 @@ type cmdDisable struct {
 type cmdDaemonReload struct{}
 type cmdStart struct {
 	Conn *NetConn
+	Opts *globalOptions `no-flag:"true"`
 }
 type cmdStop struct {
 	Conn *NetConn
+	Opts *globalOptions `no-flag:"true"`
 }
 type cmdRestart struct {
 	Conn *NetConn
+	Opts *globalOptions `no-flag:"true"`
 }
 type cmdReload struct {
 	Conn *NetConn
+	Opts *globalOptions `no-flag:"true"`
+}
+type cmdKill struct {
+	Opts *globalOptions `no-flag:"true"`
+}
+type cmdStatus struct {
+	Conn *NetConn
+	Opts *globalOptions `no-flag:"true"`
 }
-type cmdStatus struct{}
 type cmdMask struct {
 	Conn *NetConn
 }
 type cmdUnmask struct {
 	Conn *NetConn
 }
-type cmdShow struct{}
+type cmdShow struct {
+	Opts *globalOptions `no-flag:"true"`
+}
 type cmdList struct{}
 type cmdCreateInstance struct{}
 type cmdDeleteInstance struct{}
 type cmdSetEnvironment struct{}
 type cmdUnsetEnvironment struct{}
+type cmdShowEnvironment struct{}
+type cmdImportEnvironment struct{}
+type cmdListJobs struct {
+	Opts *globalOptions `no-flag:"true"`
+}
+type cmdListTimers struct {
+	Opts *globalOptions `no-flag:"true"`
+}
+type cmdListDependencies struct {
+	Opts *globalOptions `no-flag:"true"`
+}
+type cmdListUnits struct {
+	Opts *globalOptions `no-flag:"true"`
+}
+type cmdListUnitFiles struct {
+	Opts *globalOptions `no-flag:"true"`
+}
+type cmdIsEnabled struct {
+	Conn *NetConn
+	Opts *globalOptions `no-flag:"true"`
+}
+type cmdIsActive struct {
+	Conn *NetConn
+	Opts *globalOptions `no-flag:"true"`
+}
+type cmdResetFailed struct{}
+type cmdIsFailed struct {
+	Conn *NetConn
+	Opts *globalOptions `no-flag:"true"`
+}
+type cmdCancel struct{}
+type cmdCat struct{}
+type cmdEdit struct {
+	Force  bool   `long:"force" description:"create the unit or drop-in if it does not exist"`
+	DropIn string `long:"drop-in" default:"override" description:"name of the drop-in file to edit"`
+}
+type cmdRevert struct {
+	Conn *NetConn
+}
+type cmdAddWants struct {
+	Conn *NetConn
+}
+type cmdAddRequires struct {
+	Conn *NetConn
+}
 
 type cmdResponse struct {
-	message string
-	isError bool
+	message  string
+	isError  bool
+	exitCode int // exit code of systemctl for errors, 1 if not set
 }
 
 func (c cmdResponse) Error() string {
@@ -89,7 +205,42 @@ func MakeResponse(msg string, isError bool) cmdResponse {
 	}
 }
 
+// MakeExitResponse returns a response which makes systemctl exit with the exit code; the message is only printed if
+// not empty
+func MakeExitResponse(msg string, exitCode int) cmdResponse {
+	return cmdResponse{
+		message:  msg,
+		isError:  exitCode != 0,
+		exitCode: exitCode,
+	}
+}
+
+// jsonOutput returns the value encoded as JSON when --output asks for it, and false for the text output
+func jsonOutput(opts *globalOptions, v any) (string, bool) {
+	var out []byte
+	switch opts.Output {
+	case "json":
+		out, _ = json.Marshal(v)
+	case "json-pretty":
+		out, _ = json.MarshalIndent(v, "", "  ")
+	default:
+		return "", false
+	}
+	return string(out), true
+}
+
+// findDaemons returns the named units, reloading the unit files for a unit which is not loaded yet
 func findDaemons(names []string) ([]daemons.Daemon, error) {
+	return unitsByName(names, true)
+}
+
+// lookupDaemons returns the named units for read-only verbs, which do not reload the unit files
+func lookupDaemons(names []string) ([]daemons.Daemon, error) {
+	return unitsByName(names, false)
+}
+
+func unitsByName(names []string, reload bool) ([]daemons.Daemon, error) {
+	d := getDaemons()
 	if len(names) == 0 {
 		return nil, errors.New("service name not provided; usage: systemctl command servicename")
 	}
@@ -97,9 +248,13 @@ func findDaemons(names []string) ([]daemons.Daemon, error) {
 	if d == nil {
 		return ds, nil
 	}
+	find := d.Lookup
+	if reload {
+		find = d.Find
+	}
 	for _, service := range names {
 		service = strings.TrimSuffix(service, ".service")
-		daemon, err := d.Find(service)
+		daemon, err := find(service)
 		if err != nil {
 			return ds, fmt.Errorf("%s: %s", service, err)
 		}
@@ -109,6 +264,7 @@ func findDaemons(names []string) ([]daemons.Daemon, error) {
 }
 
 func (c *cmdCreateInstance) Execute(args []string) error {
+	d := getDaemons()
 	for _, arg := range args {
 		sp := strings.Split(arg, "@")
 		ds, err := d.Find(sp[0] + "@")
@@ -128,6 +284,7 @@ func (c *cmdCreateInstance) Execute(args []string) error {
 }
 
 func (c *cmdDeleteInstance) Execute(args []string) error {
+	d := getDaemons()
 	for _, arg := range args {
 		ds, err := d.Find(arg)
 		if err != nil {
@@ -146,6 +303,7 @@ func (c *cmdDeleteInstance) Execute(args []string) error {
 }
 
 func (c *cmdEnable) Execute(args []string) error {
+	d := getDaemons()
 	needReload := false
 	for _, arg := range args {
 		if !strings.Contains(arg, "@") {
@@ -185,17 +343,7 @@ func (c *cmdEnable) Execute(args []string) error {
 		}
 	}
 	if c.Now {
-		for _, daemon := range ds {
-			c.Conn.Printf("Starting %s ... ", daemon.Name())
-			err := daemon.Start()
-			if err != nil {
-				c.Conn.Println("FAIL")
-				return MakeResponse(daemon.Name()+": "+err.Error(), true)
-			} else {
-				c.Conn.Println("OK")
-			}
-		}
-		return nil
+		return runJobs(c.Conn, c.Opts, ds, "start", "Starting")
 	}
 	return nil
 }
@@ -219,10 +367,12 @@ func (c *cmdDisable) Execute(args []string) error {
 }
 
 func (c *cmdDaemonReload) Execute(args []string) error {
+	d := getDaemons()
 	return d.Reload()
 }
 
 func (c *cmdStart) Execute(args []string) error {
+	d := getDaemons()
 	needReload := false
 	for _, arg := range args {
 		if !strings.Contains(arg, "@") {
@@ -251,17 +401,7 @@ func (c *cmdStart) Execute(args []string) error {
 	if err != nil {
 		return MakeResponse(err.Error(), true)
 	}
-	for _, daemon := range ds {
-		c.Conn.Printf("Starting %s ... ", daemon.Name())
-		err := daemon.Start()
-		if err != nil {
-			c.Conn.Println("FAIL")
-			return MakeResponse(daemon.Name()+": "+err.Error(), true)
-		} else {
-			c.Conn.Println("OK")
-		}
-	}
-	return nil
+	return runJobs(c.Conn, c.Opts, ds, "start", "Starting")
 }
 
 func (c *cmdStop) Execute(args []string) error {
@@ -269,17 +409,7 @@ func (c *cmdStop) Execute(args []string) error {
 	if err != nil {
 		return MakeResponse(err.Error(), true)
 	}
-	for _, daemon := range ds {
-		c.Conn.Printf("Stopping %s ... ", daemon.Name())
-		err := daemon.Stop()
-		if err != nil {
-			c.Conn.Println("FAIL")
-			return MakeResponse(daemon.Name()+": "+err.Error(), true)
-		} else {
-			c.Conn.Println("OK")
-		}
-	}
-	return nil
+	return runJobs(c.Conn, c.Opts, ds, "stop", "Stopping")
 }
 
 func (c *cmdRestart) Execute(args []string) error {
@@ -287,32 +417,57 @@ func (c *cmdRestart) Execute(args []string) error {
 	if err != nil {
 		return MakeResponse(err.Error(), true)
 	}
+	return runJobs(c.Conn, c.Opts, ds, "restart", "Restarting")
+}
+
+func (c *cmdReload) Execute(args []string) error {
+	ds, err := findDaemons(args)
+	if err != nil {
+		return MakeResponse(err.Error(), true)
+	}
+	return runJobs(c.Conn, c.Opts, ds, "reload", "Reloading")
+}
+
+// runJobs queues a job for each unit and, unless --no-block is given, waits for the jobs to finish
+func runJobs(conn *NetConn, opts *globalOptions, ds []daemons.Daemon, jobType string, verb string) error {
+	d := getDaemons()
+	jobs := []*daemons.Job{}
 	for _, daemon := range ds {
-		c.Conn.Printf("Restarting %s ... ", daemon.Name())
-		err := daemon.Restart()
+		job, err := d.Enqueue(daemon.Name(), jobType, opts.JobMode)
 		if err != nil {
-			c.Conn.Println("FAIL")
 			return MakeResponse(daemon.Name()+": "+err.Error(), true)
-		} else {
-			c.Conn.Println("OK")
 		}
+		jobs = append(jobs, job)
+	}
+	for i, daemon := range ds {
+		conn.Printf("%s %s ... ", verb, daemon.Name())
+		if opts.NoBlock {
+			conn.Printfln("queued as job %d", jobs[i].ID())
+			continue
+		}
+		err := jobs[i].Wait()
+		if err != nil {
+			conn.Println("FAIL")
+			return MakeResponse(daemon.Name()+": "+err.Error(), true)
+		}
+		conn.Println("OK")
 	}
 	return nil
 }
 
-func (c *cmdReload) Execute(args []string) error {
-	ds, err := findDaemons(args)
+// Execute sends the signal to the processes of the units; the units are not stopped, they notice the processes exiting
+func (c *cmdKill) Execute(args []string) error {
+	sig, err := daemons.ParseSignal(c.Opts.Signal)
+	if err != nil {
+		return MakeResponse(err.Error(), true)
+	}
+	ds, err := lookupDaemons(args)
 	if err != nil {
 		return MakeResponse(err.Error(), true)
 	}
 	for _, daemon := range ds {
-		c.Conn.Printf("Reloading %s ... ", daemon.Name())
-		err := daemon.Reload()
-		if err != nil {
-			c.Conn.Println("FAIL")
-			return MakeResponse(daemon.Name()+": "+err.Error(), true)
-		} else {
-			c.Conn.Println("OK")
+		if err := daemon.Kill(c.Opts.KillWhom, sig); err != nil {
+			return MakeResponse(fmt.Sprintf("Failed to kill unit %s.service: %s", daemon.Name(), err), true)
 		}
 	}
 	return nil
@@ -337,6 +492,7 @@ func (c *cmdMask) Execute(args []string) error {
 }
 
 func (c *cmdUnmask) Execute(args []string) error {
+	d := getDaemons()
 	ds, err := findDaemons(args)
 	if err != nil {
 		return MakeResponse(err.Error(), true)
@@ -351,30 +507,72 @@ func (c *cmdUnmask) Execute(args []string) error {
 			c.Conn.Println("OK")
 		}
 	}
+	err = d.Reload()
+	if err != nil {
+		return MakeResponse("Reload(): "+err.Error(), true)
+	}
 	return nil
 }
 
+// Execute shows the status of the units in systemd's layout; the exit code is 3 if a unit is not active, the LSB code
+// for a program which is not running, and 4 if a unit does not exist
 func (c *cmdStatus) Execute(args []string) error {
-	if len(args) == 0 {
+	d := getDaemons()
+	if d == nil {
+		return MakeResponse("system is still booting", true)
+	}
+	overview := len(args) == 0
+	if overview {
 		args = d.List()
 	}
-	ds, err := findDaemons(args)
-	if err != nil {
-		return MakeResponse(err.Error(), true)
+	opts := daemons.StatusOptions{
+		Lines:   c.Opts.Lines,
+		Full:    c.Opts.Full,
+		Color:   c.Opts.Color,
+		Columns: c.Opts.Columns,
 	}
-	retMsg := ""
-	for _, daemon := range ds {
-		ret, err := daemon.Status()
-		if retMsg == "" {
-			retMsg = ret + ": " + daemon.Name()
+	exitCode := 0
+	printed := false
+	texts := []string{}
+	statuses := []daemons.UnitStatus{}
+	for _, arg := range args {
+		name := strings.TrimSuffix(arg, ".service")
+		x, err := d.Lookup(name)
+		if err != nil {
+			texts = append(texts, fmt.Sprintf("Unit %s.service could not be found.", name))
+			statuses = append(statuses, daemons.UnitStatus{
+				Unit:        name + ".service",
+				LoadState:   daemons.LoadStateNotFound,
+				ActiveState: daemons.ActiveStateInactive,
+				SubState:    daemons.SubStateDead,
+				Result:      daemons.ResultSuccess,
+			})
+			if exitCode == 0 {
+				exitCode = 4
+			}
+			continue
+		}
+		if c.Opts.Output == "short" {
+			if printed {
+				texts = append(texts, "")
+			}
+			texts = append(texts, x.Status(opts))
+			printed = true
 		} else {
-			retMsg += "\n" + ret + ": " + daemon.Name()
+			statuses = append(statuses, x.StatusInfo(opts.Lines))
 		}
-		if err != nil {
-			retMsg += " ERROR: " + err.Error()
+		if active := x.ActiveState(); active != daemons.ActiveStateActive && active != daemons.ActiveStateReloading && exitCode == 0 {
+			exitCode = 3
 		}
 	}
-	return MakeResponse(retMsg, false)
+	out, ok := jsonOutput(c.Opts, statuses)
+	if !ok {
+		out = strings.Join(texts, "\n")
+	}
+	if exitCode != 0 && !overview {
+		return MakeExitResponse(out, exitCode)
+	}
+	return MakeResponse(out, false)
 }
 
 func (c *cmdPoweroff) Execute(args []string) error {
@@ -384,45 +582,245 @@ func (c *cmdPoweroff) Execute(args []string) error {
 	return response
 }
 
+func (c *cmdReboot) Execute(args []string) error {
+	return reboot("Rebooting system...")
+}
+
+func (c *cmdSoftReboot) Execute(args []string) error {
+	return reboot("Rebooting userspace...")
+}
+
+// reboot starts the soft-reboot in the background, so that the response can be sent before the services are stopped
+func reboot(message string) error {
+	go softReboot(nil, false)
+	var response cmdResponse
+	response.message = message
+	return response
+}
+
+// Execute shows the properties of the units, or of the manager if no unit is given, as key=value lines; empty
+// properties are only shown with --all or when asked for by name
 func (c *cmdShow) Execute(args []string) error {
-	ds, err := findDaemons(args)
-	if err != nil {
-		return MakeResponse(err.Error(), true)
+	d := getDaemons()
+	if d == nil {
+		return MakeResponse("system is still booting", true)
 	}
-	details := ""
-	for _, daemon := range ds {
-		details = details + fmt.Sprintf("=== %s ===\n", daemon.Name())
-		out := daemon.Detail()
-		details = details + out
+	opts := c.Opts
+	names := splitList(append(opts.Property, opts.PropertyValue...))
+	value := opts.Value || len(opts.PropertyValue) > 0
+	filter := func(props []daemons.Property) []daemons.Property {
+		ret := []daemons.Property{}
+		for _, prop := range props {
+			if len(names) > 0 && !inslice.HasString(names, prop.Name) {
+				continue
+			}
+			if prop.Value == "" && !opts.All && len(names) == 0 {
+				continue
+			}
+			ret = append(ret, prop)
+		}
+		return ret
+	}
+	format := func(props []daemons.Property) string {
+		lines := []string{}
+		for _, prop := range filter(props) {
+			if value {
+				lines = append(lines, prop.Value)
+			} else {
+				lines = append(lines, prop.Name+"="+prop.Value)
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+	if len(args) == 0 {
+		if out, ok := jsonOutput(opts, propertiesObject(filter(managerProperties()))); ok {
+			return MakeResponse(out, false)
+		}
+		return MakeResponse(format(managerProperties()), false)
+	}
+	units := []string{}
+	objects := []map[string]any{}
+	for _, arg := range args {
+		name := strings.TrimSuffix(arg, ".service")
+		props := []daemons.Property{
+			{Name: "Id", Value: name + ".service"},
+			{Name: "Names", Value: name + ".service"},
+			{Name: "LoadState", Value: string(daemons.LoadStateNotFound)},
+			{Name: "ActiveState", Value: string(daemons.ActiveStateInactive)},
+			{Name: "SubState", Value: string(daemons.SubStateDead)},
+		}
+		if x, err := d.Lookup(name); err == nil {
+			props = x.Properties()
+		}
+		units = append(units, format(props))
+		objects = append(objects, propertiesObject(filter(props)))
+	}
+	if out, ok := jsonOutput(opts, objects); ok {
+		return MakeResponse(out, false)
+	}
+	return MakeResponse(strings.Join(units, "\n\n"), false)
+}
+
+// propertiesObject returns the properties for show --output=json; the command lines, e.g. ExecStart=, are always
+// lists as a unit may have several of them
+func propertiesObject(props []daemons.Property) map[string]any {
+	obj := map[string]any{}
+	for _, prop := range props {
+		if strings.HasPrefix(prop.Name, "Exec") && !strings.HasPrefix(prop.Name, "ExecMain") {
+			list, _ := obj[prop.Name].([]string)
+			if list == nil {
+				list = []string{}
+			}
+			if prop.Value != "" {
+				list = append(list, prop.Value)
+			}
+			obj[prop.Name] = list
+			continue
+		}
+		obj[prop.Name] = prop.Value
+	}
+	return obj
+}
+
+// managerProperties returns the properties of the service manager itself
+func managerProperties() []daemons.Property {
+	d := getDaemons()
+	units := d.List()
+	failed := 0
+	for _, name := range units {
+		if x, err := d.Find(name); err == nil && x.ActiveState() == daemons.ActiveStateFailed {
+			failed++
+		}
+	}
+	state := "running"
+	if failed > 0 {
+		state = "degraded"
+	}
+	bootTime := ""
+	if t, _, err := common.ReadBootFile(); err == nil {
+		bootTime = t.Format("Mon 2006-01-02 15:04:05 MST")
+	}
+	arch := runtime.GOARCH
+	if arch == "amd64" {
+		arch = "x86-64"
+	}
+	return []daemons.Property{
+		{Name: "Version", Value: Version},
+		{Name: "Architecture", Value: arch},
+		{Name: "UserspaceTimestamp", Value: bootTime},
+		{Name: "Environment", Value: daemons.FormatEnvironment(d.Environment())},
+		{Name: "UnitPath", Value: strings.Join(common.GetSystemdPaths(), " ")},
+		{Name: "NNames", Value: strconv.Itoa(len(units))},
+		{Name: "NFailedUnits", Value: strconv.Itoa(failed)},
+		{Name: "NJobs", Value: strconv.Itoa(len(d.Jobs()))},
+		{Name: "SystemState", Value: state},
 	}
-	return MakeResponse(details, false)
 }
 
 func (c *cmdList) Execute(args []string) error {
+	d := getDaemons()
 	ds := d.List()
 	for i := range ds {
 		x, err := d.Find(ds[i])
-		if err == nil && x.IsEnabled() {
+		if err != nil {
+			continue
+		}
+		if x.IsEnabled() {
 			ds[i] += " (enabled)"
 		}
+		if ls := x.LoadState(); ls != daemons.LoadStateLoaded {
+			ds[i] += " (" + string(ls) + ")"
+		}
 	}
 	return MakeResponse(strings.Join(ds, "\n"), false)
 }
 
+// hasVerb reports whether the arguments name a command, rather than consisting of options only
+func hasVerb(args []string) bool {
+	return Verb(args) != ""
+}
+
+// Verb returns the command name from the arguments
+func Verb(args []string) string {
+	if _, positional := SplitArgs(args); len(positional) > 0 {
+		return positional[0]
+	}
+	return ""
+}
+
+// SplitArgs splits the arguments into the options, with their values, and the positional arguments, the first of
+// which is the command verb; the values of options which take one are not taken for the verb, e.g. in
+// systemctl --state failed. systemctl uses it for the commands it resolves client-side
+func SplitArgs(args []string) (options []string, positional []string) {
+	p := flags.NewParser(NewCmd(nil), flags.None)
+	c := p.Command
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return options, append(positional, args[i+1:]...)
+		case strings.HasPrefix(arg, "--"):
+			options = append(options, arg)
+			name, _, hasValue := strings.Cut(arg[2:], "=")
+			if !hasValue && i+1 < len(args) && takesValue(c.FindOptionByLongName(name)) {
+				i++
+				options = append(options, args[i])
+			}
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			// short options may be grouped; the first one taking a value takes the rest, or else the next argument
+			options = append(options, arg)
+			for j, r := range arg[1:] {
+				if takesValue(c.FindOptionByShortName(r)) {
+					if j == len(arg)-2 && i+1 < len(args) {
+						i++
+						options = append(options, args[i])
+					}
+					break
+				}
+			}
+		default:
+			if len(positional) == 0 {
+				// the options of the command are known once it is found
+				if sub := p.Find(arg); sub != nil {
+					c = sub
+				}
+			}
+			positional = append(positional, arg)
+		}
+	}
+	return options, positional
+}
+
+// takesValue returns true for an option which needs a value
+func takesValue(o *flags.Option) bool {
+	return o != nil && !o.OptionalArgument && reflect.ValueOf(o.Value()).Kind() != reflect.Bool
+}
+
 func command(args []string, conn *NetConn) (retCode int) {
 	log.Printf("COMMAND: Received command %v", args)
 	c := NewCmd(conn)
 	p := flags.NewParser(c, flags.HelpFlag|flags.PassDoubleDash)
-	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" {
+	if !hasVerb(args) && (inslice.HasString(args, "-h") || inslice.HasString(args, "--help")) {
 		var helpMsg bytes.Buffer
 		p.WriteHelp(&helpMsg)
 		conn.Println(helpMsg.String())
 		return 0
 	}
+	// systemctl without a command lists the units, e.g. systemctl --failed
+	if !hasVerb(args) {
+		args = append(args, "list-units")
+	}
 	_, err := p.ParseArgs(args)
 	if err != nil {
 		switch msg := err.(type) {
 		case cmdResponse:
+			if msg.isError && msg.exitCode != 0 {
+				log.Printf("COMMAND: %v Exit %d %s", args, msg.exitCode, msg.Error())
+				if msg.message != "" {
+					conn.Println(msg.message)
+				}
+				return msg.exitCode
+			}
 			if msg.isError {
 				log.Printf("COMMAND: %v Error %s", args, msg.Error())
 				conn.Println(msg.Error())
@@ -431,18 +829,16 @@ func command(args []string, conn *NetConn) (retCode int) {
 			log.Printf("COMMAND: %v Success", args)
 			conn.Println(msg.message)
 			return 0
-		case *flags.Error:
-			if msg.Type == flags.ErrUnknownCommand {
-				log.Printf("COMMAND: %v soft-error %s", args, msg.Error())
-				conn.Println(msg.Error())
-				return 0
-			}
 		default:
-			if strings.HasPrefix(err.Error(), "Unknown command") {
-				log.Printf("COMMAND: %v soft-error %s", args, msg.Error())
+			if e, ok := err.(*flags.Error); ok && e.Type == flags.ErrHelp {
 				conn.Println(msg.Error())
 				return 0
 			}
+			if e, ok := err.(*flags.Error); (ok && e.Type == flags.ErrUnknownCommand) || strings.HasPrefix(err.Error(), "Unknown command") {
+				log.Printf("COMMAND: %v ERROR %s", args, msg.Error())
+				conn.Println(fmt.Sprintf("Unknown command verb '%s'.", Verb(args)))
+				return 1
+			}
 			log.Printf("COMMAND: %v ERROR %s", args, msg.Error())
 			conn.Println(msg.Error())
 			return 1
@@ -482,27 +878,722 @@ func NewCmd(connection *NetConn) *cmd {
 				conn := value.Field(i).FieldByName("Conn")
 				conn.Set(reflect.ValueOf(connection))
 			}
+			if _, ok := value.Type().Field(i).Type.FieldByName("Opts"); ok {
+				value.Field(i).FieldByName("Opts").Set(reflect.ValueOf(&c.Opts))
+			}
 		}
 	}
 	return c
 }
 
 func (c *cmdSetEnvironment) Execute(args []string) error {
-	for _, arg := range args {
-		os.Unsetenv(arg)
+	d := getDaemons()
+	if len(args) == 0 {
+		return MakeResponse("usage: systemctl set-environment VARIABLE=VALUE...", true)
+	}
+	if d == nil {
+		return MakeResponse("system is still booting", true)
+	}
+	if err := d.SetEnvironment(args); err != nil {
+		return MakeResponse(err.Error(), true)
 	}
 	return nil
 }
 
 func (c *cmdUnsetEnvironment) Execute(args []string) error {
+	d := getDaemons()
+	if len(args) == 0 {
+		return MakeResponse("usage: systemctl unset-environment VARIABLE...", true)
+	}
+	if d == nil {
+		return MakeResponse("system is still booting", true)
+	}
+	if err := d.UnsetEnvironment(args); err != nil {
+		return MakeResponse(err.Error(), true)
+	}
+	return nil
+}
+
+// the systemctl client resolves the variable names against its own environment and sends VARIABLE=VALUE pairs
+func (c *cmdImportEnvironment) Execute(args []string) error {
+	d := getDaemons()
+	if d == nil {
+		return MakeResponse("system is still booting", true)
+	}
+	if err := d.SetEnvironment(args); err != nil {
+		return MakeResponse(err.Error(), true)
+	}
+	return nil
+}
+
+func (c *cmdShowEnvironment) Execute(args []string) error {
+	d := getDaemons()
+	if d == nil {
+		return MakeResponse("system is still booting", true)
+	}
+	return MakeResponse(strings.Join(d.Environment(), "\n"), false)
+}
+
+// jobListEntry is a row of list-jobs --output=json
+type jobListEntry struct {
+	Job   int    `json:"job"`
+	Unit  string `json:"unit"`
+	Type  string `json:"type"`
+	State string `json:"state"`
+}
+
+func (c *cmdListJobs) Execute(args []string) error {
+	d := getDaemons()
+	if d == nil {
+		return MakeResponse("system is still booting", true)
+	}
+	jobs := d.Jobs()
+	entries := []jobListEntry{}
+	for _, job := range jobs {
+		entries = append(entries, jobListEntry{Job: job.ID, Unit: job.Unit, Type: job.Type, State: job.State})
+	}
+	if out, ok := jsonOutput(c.Opts, entries); ok {
+		return MakeResponse(out, false)
+	}
+	if len(jobs) == 0 {
+		return MakeResponse("No jobs running.", false)
+	}
+	w := 4
+	for _, job := range jobs {
+		w = max(w, len(job.Unit))
+	}
+	lines := []string{fmt.Sprintf("%4s %-*s %-15s %s", "JOB", w, "UNIT", "TYPE", "STATE")}
+	for _, job := range jobs {
+		lines = append(lines, fmt.Sprintf("%4d %-*s %-15s %s", job.ID, w, job.Unit, job.Type, job.State))
+	}
+	lines = append(lines, "", fmt.Sprintf("%d jobs listed.", len(jobs)))
+	return MakeResponse(strings.Join(lines, "\n"), false)
+}
+
+// Execute lists the timer units; timer units are not supported, so there are none
+func (c *cmdListTimers) Execute(args []string) error {
+	if out, ok := jsonOutput(c.Opts, []any{}); ok {
+		return MakeResponse(out, false)
+	}
+	if c.Opts.NoLegend {
+		return nil
+	}
+	footer := "0 timers listed."
+	if !c.Opts.All {
+		footer += "\nPass --all to see loaded but inactive timers, too."
+	}
+	return MakeResponse(footer, false)
+}
+
+// dependencyEntry is a node of list-dependencies --output=json; the active state is empty for units which are not
+// services
+type dependencyEntry struct {
+	Unit         string            `json:"unit"`
+	ActiveState  string            `json:"active_state"`
+	Dependencies []dependencyEntry `json:"dependencies"`
+}
+
+// defaultTarget is the root of list-dependencies without a unit
+const defaultTarget = "multi-user.target"
+
+// Execute shows the tree of the units pulled in by the units, or with --reverse, --before or --after the units
+// depending on them or ordered against them; only the first level of services is shown unless --all is given, same as
+// systemd which only recurses into targets by default
+func (c *cmdListDependencies) Execute(args []string) error {
+	d := getDaemons()
+	if d == nil {
+		return MakeResponse("system is still booting", true)
+	}
+	opts := c.Opts
+	direction := "requires"
+	switch {
+	case opts.Reverse:
+		direction = "reverse"
+	case opts.Before:
+		direction = "before"
+	case opts.After:
+		direction = "after"
+	}
+	if len(args) == 0 {
+		args = []string{defaultTarget}
+	}
+	var tree func(unit string, path []string) dependencyEntry
+	tree = func(unit string, path []string) dependencyEntry {
+		entry := dependencyEntry{Unit: unit, Dependencies: []dependencyEntry{}}
+		var deps []string
+		if unit == defaultTarget {
+			if direction == "requires" {
+				deps = defaultTargetWants()
+			}
+		} else if x, err := d.Find(strings.TrimSuffix(unit, ".service")); err == nil && strings.HasSuffix(unit, ".service") {
+			entry.ActiveState = string(x.ActiveState())
+			deps = x.Dependencies(direction)
+		}
+		if len(path) > 1 && !opts.All {
+			return entry
+		}
+		for _, dep := range deps {
+			if inslice.HasString(path, dep) {
+				continue
+			}
+			entry.Dependencies = append(entry.Dependencies, tree(dep, append(path, dep)))
+		}
+		return entry
+	}
+	entries := []dependencyEntry{}
+	for _, arg := range args {
+		unit := arg
+		if !strings.Contains(unit, ".") {
+			unit += ".service"
+		}
+		entries = append(entries, tree(unit, []string{unit}))
+	}
+	if out, ok := jsonOutput(opts, entries); ok {
+		return MakeResponse(out, false)
+	}
+	lines := []string{}
+	var walk func(deps []dependencyEntry, prefix string)
+	walk = func(deps []dependencyEntry, prefix string) {
+		for i, dep := range deps {
+			branch, indent := "├─", "│ "
+			if i == len(deps)-1 {
+				branch, indent = "└─", "  "
+			}
+			if opts.Plain {
+				branch, indent = "  ", "  "
+			}
+			line := prefix + branch + dep.Unit
+			if !opts.Plain {
+				bullet, on := "●", ""
+				switch daemons.ActiveState(dep.ActiveState) {
+				case daemons.ActiveStateActive, daemons.ActiveStateReloading:
+					on = ansiHighlightGreen
+				case daemons.ActiveStateFailed:
+					on = ansiHighlightRed
+				case daemons.ActiveStateInactive, "":
+					bullet = "○"
+				}
+				if opts.Color && on != "" {
+					bullet = on + bullet + ansiNormal
+				}
+				line = bullet + " " + line
+			}
+			lines = append(lines, line)
+			walk(dep.Dependencies, prefix+indent)
+		}
+	}
+	for _, entry := range entries {
+		lines = append(lines, entry.Unit)
+		walk(entry.Dependencies, "")
+	}
+	return MakeResponse(strings.Join(lines, "\n"), false)
+}
+
+// defaultTargetWants returns the enabled services, which are pulled in by the default target
+func defaultTargetWants() []string {
+	d := getDaemons()
+	units := []string{}
+	for _, name := range d.List() {
+		if x, err := d.Find(name); err == nil && x.IsEnabled() {
+			units = append(units, name+".service")
+		}
+	}
+	return units
+}
+
+func (c *cmdCancel) Execute(args []string) error {
+	d := getDaemons()
+	if d == nil {
+		return MakeResponse("system is still booting", true)
+	}
+	ids := []int{}
+	if len(args) == 0 {
+		for _, job := range d.Jobs() {
+			ids = append(ids, job.ID)
+		}
+	}
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil || id <= 0 {
+			return MakeResponse(fmt.Sprintf("Failed to parse job id \"%s\"", arg), true)
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		if err := d.CancelJob(id); err != nil {
+			return MakeResponse(fmt.Sprintf("Failed to cancel job %d: %s", id, err), true)
+		}
+	}
+	return nil
+}
+
+// Execute prints the unit files of the units, separated by a blank line
+func (c *cmdCat) Execute(args []string) error {
+	d := getDaemons()
+	if d == nil {
+		return MakeResponse("system is still booting", true)
+	}
+	if len(args) == 0 {
+		return MakeResponse("No units specified.", true)
+	}
+	texts := []string{}
+	for _, arg := range args {
+		name := strings.TrimSuffix(arg, ".service")
+		x, err := d.Find(name)
+		if err != nil {
+			return MakeExitResponse(strings.Join(append(texts, "No files found for "+name+".service."), "\n\n"), 1)
+		}
+		text, err := x.Cat()
+		if err != nil {
+			return MakeExitResponse(strings.Join(append(texts, err.Error()), "\n\n"), 1)
+		}
+		texts = append(texts, text)
+	}
+	return MakeResponse(strings.Join(texts, "\n\n"), false)
+}
+
+// Execute reloads the unit files after systemctl has run the editor, and reports the units which do not load; the
+// files themselves are written by systemctl
+func (c *cmdEdit) Execute(args []string) error {
+	d := getDaemons()
+	if d == nil {
+		return MakeResponse("system is still booting", true)
+	}
+	if err := d.Reload(); err != nil {
+		return MakeResponse("Reload(): "+err.Error(), true)
+	}
+	texts := []string{}
+	for _, arg := range args {
+		name := strings.TrimSuffix(arg, ".service")
+		x, err := d.Find(name)
+		if err != nil {
+			continue
+		}
+		switch x.LoadState() {
+		case daemons.LoadStateBadSetting, daemons.LoadStateError:
+			texts = append(texts, fmt.Sprintf("Unit %s.service has errors:", name))
+			texts = append(texts, x.LoadMessages()...)
+		}
+	}
+	if len(texts) > 0 {
+		return MakeExitResponse(strings.Join(texts, "\n"), 1)
+	}
+	return nil
+}
+
+// Execute removes the local configuration of the units and reloads
+func (c *cmdRevert) Execute(args []string) error {
+	d := getDaemons()
+	ds, err := findDaemons(args)
+	if err != nil {
+		return MakeResponse(err.Error(), true)
+	}
+	for _, daemon := range ds {
+		removed, err := daemon.Revert()
+		for _, p := range removed {
+			c.Conn.Printf("Removed \"%s\".\n", p)
+		}
+		if err != nil {
+			return MakeResponse(daemon.Name()+": "+err.Error(), true)
+		}
+	}
+	if err := d.Reload(); err != nil {
+		return MakeResponse("Reload(): "+err.Error(), true)
+	}
+	return nil
+}
+
+func (c *cmdAddWants) Execute(args []string) error {
+	return addDependency(c.Conn, args, false)
+}
+
+func (c *cmdAddRequires) Execute(args []string) error {
+	return addDependency(c.Conn, args, true)
+}
+
+// addDependency links the units given after the target into its .wants/ or .requires/ directory and reloads
+func addDependency(conn *NetConn, args []string, requires bool) error {
+	d := getDaemons()
+	if len(args) < 2 {
+		return MakeResponse("target and units not provided; usage: systemctl add-wants|add-requires target unit...", true)
+	}
+	target := args[0]
+	if !strings.Contains(target, ".") {
+		target += ".service"
+	}
+	ds, err := findDaemons(args[1:])
+	if err != nil {
+		return MakeResponse(err.Error(), true)
+	}
+	for _, daemon := range ds {
+		link, err := daemon.AddDependency(target, requires)
+		if err != nil {
+			return MakeResponse(daemon.Name()+": "+err.Error(), true)
+		}
+		if link != "" {
+			dest, _ := os.Readlink(link)
+			conn.Printf("Created symlink %s → %s.\n", link, dest)
+		}
+	}
+	if err := d.Reload(); err != nil {
+		return MakeResponse("Reload(): "+err.Error(), true)
+	}
+	return nil
+}
+
+const (
+	ansiHighlightRed   = "\x1b[0;1;31m"
+	ansiHighlightGreen = "\x1b[0;1;32m"
+	ansiUnderline      = "\x1b[0;4m"
+	ansiNormal         = "\x1b[0m"
+)
+
+// formatTable aligns the columns of the rows under the header, the last column is not padded; with colour, the header
+// is underlined and the cells for which highlight returns an escape sequence are shown in that colour
+func formatTable(header []string, rows [][]string, color bool, highlight func(row int, col int) string) []string {
+	widths := make([]int, len(header))
+	for _, row := range append([][]string{header}, rows...) {
+		for i, col := range row {
+			widths[i] = max(widths[i], utf8.RuneCountInString(col))
+		}
+	}
+	lines := []string{}
+	for r, row := range append([][]string{header}, rows...) {
+		line := ""
+		for i, col := range row {
+			cell := col
+			if i != len(row)-1 {
+				cell = col + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(col))
+			}
+			if color && r > 0 && highlight != nil {
+				if on := highlight(r-1, i); on != "" {
+					cell = on + cell + ansiNormal
+				}
+			}
+			if i != len(row)-1 {
+				cell += " "
+			}
+			line += cell
+		}
+		line = strings.TrimRight(line, " ")
+		if color && r == 0 {
+			line = ansiUnderline + line + ansiNormal
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// splitList returns the comma-separated values given to a list option, e.g. --state=failed,exited
+func splitList(values []string) []string {
+	ret := []string{}
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item != "" {
+				ret = append(ret, item)
+			}
+		}
+	}
+	return ret
+}
+
+// matchUnit reports whether the unit matches one of the patterns, or there are no patterns; a pattern without a
+// glob or unit type suffix names a service
+func matchUnit(unit string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if !strings.ContainsAny(pattern, "*?[") && !strings.Contains(pattern, ".") {
+			pattern += ".service"
+		}
+		if ok, _ := path.Match(pattern, unit); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// unitListEntry is a row of list-units --output=json
+type unitListEntry struct {
+	Unit        string `json:"unit"`
+	Load        string `json:"load"`
+	Active      string `json:"active"`
+	Sub         string `json:"sub"`
+	Description string `json:"description"`
+}
+
+// Execute lists the units matching the patterns in systemd's format; only active and failed units are listed unless
+// --all or --state= is given
+func (c *cmdListUnits) Execute(args []string) error {
+	d := getDaemons()
+	if d == nil {
+		return MakeResponse("system is still booting", true)
+	}
+	opts := c.Opts
+	states := splitList(opts.State)
+	if opts.Failed {
+		states = append(states, string(daemons.ActiveStateFailed))
+	}
+	types := splitList(opts.Type)
+	rows := [][]string{}
+	failed := []bool{}
+	entries := []unitListEntry{}
+	for _, name := range d.List() {
+		unit := name + ".service"
+		if len(types) > 0 && !inslice.HasString(types, "service") {
+			continue
+		}
+		if !matchUnit(unit, args) {
+			continue
+		}
+		x, err := d.Find(name)
+		if err != nil {
+			continue
+		}
+		load, active, sub := string(x.LoadState()), string(x.ActiveState()), string(x.SubState())
+		if len(states) > 0 {
+			if !inslice.HasString(states, load) && !inslice.HasString(states, active) && !inslice.HasString(states, sub) {
+				continue
+			}
+		} else if !opts.All && active == string(daemons.ActiveStateInactive) {
+			continue
+		}
+		isFailed := active == string(daemons.ActiveStateFailed) || x.LoadState() != daemons.LoadStateLoaded
+		row := []string{unit, load, active, sub, x.Description()}
+		if !opts.Plain {
+			marker := ""
+			if isFailed {
+				marker = "●"
+			}
+			row = append([]string{marker}, row...)
+		}
+		rows = append(rows, row)
+		failed = append(failed, isFailed)
+		entries = append(entries, unitListEntry{Unit: unit, Load: load, Active: active, Sub: sub, Description: x.Description()})
+	}
+	if out, ok := jsonOutput(opts, entries); ok {
+		return MakeResponse(out, false)
+	}
+	footer := fmt.Sprintf("%d loaded units listed.", len(rows))
+	if !opts.All {
+		footer += " Pass --all to see loaded but inactive units, too."
+	}
+	if len(rows) == 0 {
+		if opts.NoLegend {
+			return nil
+		}
+		return MakeResponse(footer, false)
+	}
+	header := []string{"UNIT", "LOAD", "ACTIVE", "SUB", "DESCRIPTION"}
+	col := 0 // the first column after the status marker
+	if !opts.Plain {
+		header = append([]string{" "}, header...)
+		col = 1
+	}
+	lines := formatTable(header, rows, opts.Color, func(row int, i int) string {
+		switch {
+		case i-col == -1 && failed[row],
+			i-col == 1 && rows[row][i] != string(daemons.LoadStateLoaded),
+			(i-col == 2 || i-col == 3) && rows[row][col+2] == string(daemons.ActiveStateFailed):
+			return ansiHighlightRed
+		}
+		return ""
+	})
+	if opts.NoLegend {
+		return MakeResponse(strings.Join(lines[1:], "\n"), false)
+	}
+	lines = append(lines, "",
+		"LOAD   = Reflects whether the unit definition was properly loaded.",
+		"ACTIVE = The high-level unit activation state, i.e. generalization of SUB.",
+		"SUB    = The low-level unit activation state, values depend on unit type.",
+		"",
+		footer)
+	return MakeResponse(strings.Join(lines, "\n"), false)
+}
+
+// unitFileListEntry is a row of list-unit-files --output=json; the preset is null for static, alias and generated
+// unit files
+type unitFileListEntry struct {
+	UnitFile string  `json:"unit_file"`
+	State    string  `json:"state"`
+	Preset   *string `json:"preset"`
+}
+
+// Execute lists the unit files matching the patterns with their enablement state and vendor preset
+func (c *cmdListUnitFiles) Execute(args []string) error {
+	d := getDaemons()
+	if d == nil {
+		return MakeResponse("system is still booting", true)
+	}
+	opts := c.Opts
+	states := splitList(opts.State)
+	types := splitList(opts.Type)
+	rows := [][]string{}
+	entries := []unitFileListEntry{}
+	for _, name := range d.List() {
+		unit := name + ".service"
+		if len(types) > 0 && !inslice.HasString(types, "service") {
+			continue
+		}
+		if !matchUnit(unit, args) {
+			continue
+		}
+		x, err := d.Find(name)
+		if err != nil || x.LoadState() == daemons.LoadStateNotFound {
+			continue
+		}
+		state := x.UnitFileState()
+		if len(states) > 0 && !inslice.HasString(states, string(state)) {
+			continue
+		}
+		entry := unitFileListEntry{UnitFile: unit, State: string(state)}
+		preset := "-"
+		switch state {
+		case daemons.UnitFileStatic, daemons.UnitFileAlias, daemons.UnitFileGenerated:
+		default:
+			preset = daemons.VendorPreset(unit)
+			entry.Preset = &preset
+		}
+		rows = append(rows, []string{unit, string(state), preset})
+		entries = append(entries, entry)
+	}
+	if out, ok := jsonOutput(opts, entries); ok {
+		return MakeResponse(out, false)
+	}
+	footer := fmt.Sprintf("%d unit files listed.", len(rows))
+	if len(rows) == 0 {
+		if opts.NoLegend {
+			return nil
+		}
+		return MakeResponse(footer, false)
+	}
+	lines := formatTable([]string{"UNIT FILE", "STATE", "VENDOR PRESET"}, rows, opts.Color, func(row int, i int) string {
+		switch daemons.UnitFileState(rows[row][1]) {
+		case daemons.UnitFileEnabled, daemons.UnitFileEnabledRuntime, daemons.UnitFileAlias:
+			if i == 1 {
+				return ansiHighlightGreen
+			}
+		case daemons.UnitFileDisabled, daemons.UnitFileMasked:
+			if i == 1 {
+				return ansiHighlightRed
+			}
+		}
+		switch {
+		case i == 2 && rows[row][i] == "enabled":
+			return ansiHighlightGreen
+		case i == 2 && rows[row][i] == "disabled":
+			return ansiHighlightRed
+		}
+		return ""
+	})
+	if opts.NoLegend {
+		return MakeResponse(strings.Join(lines[1:], "\n"), false)
+	}
+	lines = append(lines, "", footer)
+	return MakeResponse(strings.Join(lines, "\n"), false)
+}
+
+// Execute prints the enablement state of each unit file; the exit code is 0 if at least one of them is enabled,
+// static, indirect, an alias or generated
+func (c *cmdIsEnabled) Execute(args []string) error {
+	d := getDaemons()
+	if len(args) == 0 {
+		return MakeResponse("Too few arguments.", true)
+	}
+	if d == nil {
+		return MakeResponse("system is still booting", true)
+	}
+	enabled := false
 	for _, arg := range args {
-		if !strings.Contains(arg, "=") {
-			arg = arg + "="
+		name := strings.TrimSuffix(arg, ".service")
+		x, err := d.Lookup(name)
+		if err != nil || x.LoadState() == daemons.LoadStateNotFound {
+			return MakeResponse(fmt.Sprintf("Failed to get unit file state for %s.service: No such file or directory", name), true)
 		}
-		kv := strings.Split(arg, "=")
-		k := kv[0]
-		v := strings.Join(kv[1:], "=")
-		os.Setenv(k, v)
+		state := x.UnitFileState()
+		switch state {
+		case daemons.UnitFileEnabled, daemons.UnitFileEnabledRuntime, daemons.UnitFileStatic, daemons.UnitFileIndirect,
+			daemons.UnitFileAlias, daemons.UnitFileGenerated:
+			enabled = true
+		}
+		if !c.Opts.Quiet {
+			c.Conn.Println(string(state))
+		}
+	}
+	if !enabled {
+		return MakeExitResponse("", 1)
+	}
+	return nil
+}
+
+func (c *cmdResetFailed) Execute(args []string) error {
+	d := getDaemons()
+	if d == nil {
+		return MakeResponse("system is still booting", true)
+	}
+	if len(args) == 0 {
+		args = d.List()
+	}
+	ds, err := findDaemons(args)
+	if err != nil {
+		return MakeResponse(err.Error(), true)
+	}
+	for _, daemon := range ds {
+		daemon.ResetFailed()
+	}
+	return nil
+}
+
+// Execute prints the ActiveState of each unit; the exit code is 0 if at least one of them is active, otherwise 3, the
+// LSB code for a program which is not running
+func (c *cmdIsActive) Execute(args []string) error {
+	d := getDaemons()
+	if len(args) == 0 {
+		return MakeResponse("Too few arguments.", true)
+	}
+	if d == nil {
+		return MakeResponse("system is still booting", true)
+	}
+	active := false
+	for _, arg := range args {
+		state := daemons.ActiveStateInactive
+		if x, err := d.Lookup(strings.TrimSuffix(arg, ".service")); err == nil {
+			state = x.ActiveState()
+		}
+		active = active || state == daemons.ActiveStateActive || state == daemons.ActiveStateReloading
+		if !c.Opts.Quiet {
+			c.Conn.Println(string(state))
+		}
+	}
+	if !active {
+		return MakeExitResponse("", 3)
+	}
+	return nil
+}
+
+// Execute prints the ActiveState of each unit; the exit code is 0 if at least one of them is failed
+func (c *cmdIsFailed) Execute(args []string) error {
+	d := getDaemons()
+	if len(args) == 0 {
+		return MakeResponse("Too few arguments.", true)
+	}
+	if d == nil {
+		return MakeResponse("system is still booting", true)
+	}
+	failed := false
+	for _, arg := range args {
+		state := daemons.ActiveStateInactive
+		if x, err := d.Lookup(strings.TrimSuffix(arg, ".service")); err == nil {
+			state = x.ActiveState()
+		}
+		failed = failed || state == daemons.ActiveStateFailed
+		if !c.Opts.Quiet {
+			c.Conn.Println(string(state))
+		}
+	}
+	if !failed {
+		return MakeExitResponse("", 1)
 	}
 	return nil
 }
@@ -0,0 +1,86 @@
+package daemons
+
+import (
+	"log"
+	"time"
+)
+
+// ManagerAction is set by the manager to carry out FailureAction=, SuccessAction=, StartLimitAction= and
+// JobTimeoutAction=; the exit status is used by the exit and exit-force actions
+var ManagerAction func(ds Daemons, action string, exitStatus int)
+
+// runAction carries out one of the unit actions; exitStatus is the configured *ActionExitStatus=, or -1 to propagate
+// the exit status of the main process; called with the daemon locked
+func (d *daemon) runAction(setting string, action string, exitStatus int) {
+	if action == "" || action == "none" || ManagerAction == nil || d.isShuttingDown() {
+		return
+	}
+	if exitStatus < 0 {
+		exitStatus = 0
+		ws := d.exitStatus
+		switch {
+		case ws == nil:
+			if setting != "SuccessAction" {
+				exitStatus = 1
+			}
+		case ws.Signaled():
+			exitStatus = 128 + int(ws.Signal())
+		default:
+			exitStatus = ws.ExitStatus()
+		}
+	}
+	log.Printf("<%s> %s=%s triggered, exit status %d", d.name, setting, action, exitStatus)
+	var ds Daemons
+	if d.parent != nil {
+		ds = d.parent
+	}
+	go ManagerAction(ds, action, exitStatus)
+}
+
+// restarts reports whether the Restart= setting causes the service to be restarted after its processes finished with
+// the result
+func restarts(restart string, result Result, remainAfterExit bool) bool {
+	switch restart {
+	case "always":
+		return true
+	case "on-success":
+		return result == ResultSuccess && !remainAfterExit
+	case "on-failure":
+		return result != ResultSuccess
+	case "on-abnormal":
+		return result == ResultSignal || result == ResultCoreDump || result == ResultTimeout || result == ResultWatchdog
+	case "on-watchdog":
+		return result == ResultWatchdog
+	case "on-abort":
+		return result == ResultSignal || result == ResultCoreDump
+	}
+	return false
+}
+
+// defaultStartLimitInterval and defaultStartLimitBurst are used when StartLimitIntervalSec= and StartLimitBurst= are not
+// set, same as systemd's DefaultStartLimitIntervalSec= and DefaultStartLimitBurst=
+const (
+	defaultStartLimitInterval = 10 * time.Second
+	defaultStartLimitBurst    = 5
+)
+
+// startLimitHit records a start attempt and reports whether StartLimitBurst= starts within StartLimitIntervalSec=
+// have been exceeded; either set to 0 disables the limit; called with the daemon locked
+func (d *daemon) startLimitHit() bool {
+	if d.def.StartLimitBurst <= 0 || d.def.StartLimitInterval <= 0 {
+		return false
+	}
+	now := time.Now()
+	times := []time.Time{}
+	for _, t := range d.startTimes {
+		if d.def.StartLimitInterval == infinity || now.Sub(t) < d.def.StartLimitInterval {
+			times = append(times, t)
+		}
+	}
+	if len(times) >= d.def.StartLimitBurst {
+		d.startTimes = times
+		return true
+	}
+	d.startTimes = append(times, now)
+	return false
+}
@@ -0,0 +1,318 @@
+package daemons
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// condition is a single ConditionXXX= or AssertXXX= check from the [Unit] section
+type condition struct {
+	Type    string // e.g. PathExists
+	Assert  bool   // AssertXXX= instead of ConditionXXX=
+	Trigger bool   // prefixed with |, at least one triggering condition must pass
+	Negate  bool   // prefixed with !, the result is inverted
+	Param   string
+}
+
+// conditionTypes maps the upper-cased setting suffix to the systemd name of the check
+var conditionTypes = map[string]string{
+	"PATHEXISTS":         "PathExists",
+	"PATHEXISTSGLOB":     "PathExistsGlob",
+	"PATHISDIRECTORY":    "PathIsDirectory",
+	"PATHISSYMBOLICLINK": "PathIsSymbolicLink",
+	"PATHISMOUNTPOINT":   "PathIsMountPoint",
+	"PATHISREADWRITE":    "PathIsReadWrite",
+	"FILENOTEMPTY":       "FileNotEmpty",
+	"FILEISEXECUTABLE":   "FileIsExecutable",
+	"DIRECTORYNOTEMPTY":  "DirectoryNotEmpty",
+	"ENVIRONMENT":        "Environment",
+	"VIRTUALIZATION":     "Virtualization",
+	"USER":               "User",
+	"GROUP":              "Group",
+	"HOST":               "Host",
+	"FIRSTBOOT":          "FirstBoot",
+	"ARCHITECTURE":       "Architecture",
+}
+
+// String returns the condition as it would be written in the unit file
+func (c condition) String() string {
+	s := "Condition"
+	if c.Assert {
+		s = "Assert"
+	}
+	s += c.Type + "="
+	if c.Trigger {
+		s += "|"
+	}
+	if c.Negate {
+		s += "!"
+	}
+	return s + c.Param
+}
+
+// setCondition parses a ConditionXXX=/AssertXXX= setting, returning false if the check type is not known;
+// an empty assignment resets all conditions (or asserts) of the unit
+func (p *unitParser) setCondition(name string, val string) bool {
+	isAssert := strings.HasPrefix(name, "ASSERT")
+	ctype, ok := conditionTypes[strings.TrimPrefix(strings.TrimPrefix(name, "CONDITION"), "ASSERT")]
+	if !ok {
+		return false
+	}
+	if val == "" {
+		conds := []condition{}
+		for _, c := range p.d.def.Conditions {
+			if c.Assert != isAssert {
+				conds = append(conds, c)
+			}
+		}
+		p.d.def.Conditions = conds
+		return true
+	}
+	c := condition{
+		Type:   ctype,
+		Assert: isAssert,
+	}
+	for len(val) > 0 && (val[0] == '|' || val[0] == '!') {
+		if val[0] == '|' {
+			c.Trigger = true
+		} else {
+			c.Negate = true
+		}
+		val = strings.TrimSpace(val[1:])
+	}
+	c.Param = p.specifiers(val)
+	p.d.def.Conditions = append(p.d.def.Conditions, c)
+	return true
+}
+
+// checkConditions evaluates the conditions (or asserts) following systemd semantics: all non-triggering checks must pass,
+// and if any triggering checks are present, at least one of them must pass; returns the checks responsible for a failure
+func checkConditions(conds []condition, asserts bool, env []string) (failed []condition) {
+	hasTrigger := false
+	triggered := false
+	triggers := []condition{}
+	for _, c := range conds {
+		if c.Assert != asserts {
+			continue
+		}
+		ok, err := c.test(env)
+		if err != nil {
+			ok = false
+		}
+		if c.Negate {
+			ok = !ok
+		}
+		if c.Trigger {
+			hasTrigger = true
+			triggers = append(triggers, c)
+			if ok {
+				triggered = true
+			}
+			continue
+		}
+		if !ok {
+			failed = append(failed, c)
+		}
+	}
+	if hasTrigger && !triggered {
+		failed = append(failed, triggers...)
+	}
+	return failed
+}
+
+// test performs the check, without taking negation into account; env is the manager environment
+func (c condition) test(env []string) (bool, error) {
+	switch c.Type {
+	case "PathExists":
+		_, err := os.Stat(c.Param)
+		return err == nil, nil
+	case "PathExistsGlob":
+		m, err := filepath.Glob(c.Param)
+		return len(m) > 0, err
+	case "PathIsDirectory":
+		st, err := os.Stat(c.Param)
+		return err == nil && st.IsDir(), nil
+	case "PathIsSymbolicLink":
+		st, err := os.Lstat(c.Param)
+		return err == nil && st.Mode()&os.ModeSymlink != 0, nil
+	case "PathIsMountPoint":
+		return isMountPoint(c.Param)
+	case "PathIsReadWrite":
+		if _, err := os.Stat(c.Param); err != nil {
+			return false, nil
+		}
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(c.Param, &st); err != nil {
+			return false, err
+		}
+		return st.Flags&1 == 0, nil // ST_RDONLY
+	case "FileNotEmpty":
+		st, err := os.Stat(c.Param)
+		return err == nil && st.Mode().IsRegular() && st.Size() > 0, nil
+	case "FileIsExecutable":
+		st, err := os.Stat(c.Param)
+		return err == nil && st.Mode().IsRegular() && st.Mode()&0111 != 0, nil
+	case "DirectoryNotEmpty":
+		entries, err := os.ReadDir(c.Param)
+		if err != nil {
+			return false, nil
+		}
+		for _, e := range entries {
+			// hidden and backup files are not counted, same as systemd
+			if strings.HasPrefix(e.Name(), ".") || strings.HasSuffix(e.Name(), "~") {
+				continue
+			}
+			return true, nil
+		}
+		return false, nil
+	case "Environment":
+		for _, e := range env {
+			if strings.Contains(c.Param, "=") {
+				if e == c.Param {
+					return true, nil
+				}
+			} else if strings.HasPrefix(e, c.Param+"=") {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "Virtualization":
+		virt := detectVirtualization()
+		if b, err := parseBoolean(c.Param); err == nil {
+			return b == (virt != ""), nil
+		}
+		switch c.Param {
+		case "container":
+			return virt != "", nil
+		case "vm":
+			return false, nil
+		}
+		return c.Param == virt, nil
+	case "User":
+		uid := os.Getuid()
+		if c.Param == "@system" {
+			return uid < 1000, nil
+		}
+		if n, err := strconv.Atoi(c.Param); err == nil {
+			return n == uid, nil
+		}
+		u, err := user.Lookup(c.Param)
+		if err != nil {
+			return false, nil
+		}
+		return u.Uid == strconv.Itoa(uid), nil
+	case "Group":
+		gids, err := os.Getgroups()
+		if err != nil {
+			return false, err
+		}
+		gids = append(gids, os.Getgid())
+		gid := c.Param
+		if _, err := strconv.Atoi(c.Param); err != nil {
+			g, err := user.LookupGroup(c.Param)
+			if err != nil {
+				return false, nil
+			}
+			gid = g.Gid
+		}
+		for _, g := range gids {
+			if strconv.Itoa(g) == gid {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "Host":
+		if mid, err := os.ReadFile("/etc/machine-id"); err == nil && strings.EqualFold(strings.TrimSpace(string(mid)), c.Param) {
+			return true, nil
+		}
+		hostname, err := os.Hostname()
+		if err != nil {
+			return false, err
+		}
+		return path.Match(strings.ToLower(c.Param), strings.ToLower(hostname))
+	case "FirstBoot":
+		b, err := parseBoolean(c.Param)
+		if err != nil {
+			return false, err
+		}
+		return b == isFirstBoot(), nil
+	case "Architecture":
+		arch := map[string]string{"amd64": "x86-64", "arm64": "arm64", "386": "x86", "arm": "arm", "ppc64le": "ppc64-le", "s390x": "s390x", "riscv64": "riscv64"}[runtime.GOARCH]
+		return c.Param == "native" || c.Param == arch, nil
+	}
+	return false, errors.New("unsupported condition")
+}
+
+// detectVirtualization returns the systemd-detect-virt name of the container technology, or an empty string
+func detectVirtualization() string {
+	if v := os.Getenv("container"); v != "" {
+		return v
+	}
+	if _, err := os.Stat("/.dockerenv"); err == nil {
+		return "docker"
+	}
+	if _, err := os.Stat("/run/.containerenv"); err == nil {
+		return "podman"
+	}
+	if ct, err := os.ReadFile("/proc/1/cgroup"); err == nil {
+		s := string(ct)
+		switch {
+		case strings.Contains(s, "/docker"):
+			return "docker"
+		case strings.Contains(s, "/lxc"):
+			return "lxc"
+		}
+	}
+	return ""
+}
+
+var firstBoot struct {
+	sync.Once
+	isFirst bool
+}
+
+// isFirstBoot reports whether /etc/machine-id was missing or uninitialized when first checked during this boot
+func isFirstBoot() bool {
+	firstBoot.Do(func() {
+		mid, err := os.ReadFile("/etc/machine-id")
+		content := strings.TrimSpace(string(mid))
+		firstBoot.isFirst = err != nil || content == "" || content == "uninitialized"
+	})
+	return firstBoot.isFirst
+}
+
+func isMountPoint(p string) (bool, error) {
+	p = path.Clean(p)
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) > 4 && fields[4] == p {
+			return true, nil
+		}
+	}
+	return false, s.Err()
+}
+
+// conditionsFailedError formats failed checks for status output
+func conditionsFailedError(failed []condition) error {
+	msgs := []string{}
+	for _, c := range failed {
+		msgs = append(msgs, c.String())
+	}
+	return fmt.Errorf("%s was not met", strings.Join(msgs, ", "))
+}
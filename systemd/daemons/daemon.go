@@ -1,9 +1,10 @@
 package daemons
 
 import (
-	"bytes"
+	"crypto/rand"
 	"docker-systemd/procwait"
 	"docker-systemd/systemd/pidtracker"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
@@ -19,23 +20,41 @@ import (
 	"time"
 
 	"github.com/bestmethod/inslice"
-	"github.com/mitchellh/go-ps"
-	"gopkg.in/yaml.v3"
 )
 
 type daemon struct {
 	sync.RWMutex
-	parent     *daemons
-	state      DaemonState
-	stateError error
-	name       string
-	def        *daemondef
-	olddef     *daemondef
-	paths      []string
-	isMasked   bool
-	isManual   bool // is started as dependency or as wanted
-	cmds       []*exec.Cmd
-	pids       []int
+	parent         *daemons
+	state          DaemonState
+	subState       SubState  // the state machine position, state follows it
+	result         Result    // result of the last activation
+	stateChanged   time.Time // when the ActiveState last changed
+	activeEnter    time.Time
+	activeExit     time.Time
+	inactiveEnter  time.Time
+	inactiveExit   time.Time
+	nRestarts      int // automatic restarts since the manager started
+	stateError     error
+	conditionError error // set when the last start was skipped due to a failed condition
+	name           string
+	def            *daemondef
+	paths          []string
+	fragment       string // the unit file which was loaded
+	dropins        []string
+	loadState      LoadState
+	loadMessages   []string // parse diagnostics with file:line
+	isMasked       bool
+	isManual       bool // started manually rather than as a dependency, exempt from StopWhenUnneeded=
+	cmds           []*exec.Cmd
+	pids           []int
+	control        *exec.Cmd           // the running control process, e.g. ExecStartPre= or ExecStop=
+	startTimes     []time.Time         // start attempts within StartLimitIntervalSec=
+	invocationID   string              // INVOCATION_ID of the current activation
+	env            []string            // service environment of the current activation
+	exitStatus     *syscall.WaitStatus // exit status of the main process, or of the control process which failed the start
+	stopTimedOut   bool                // SIGKILL was applied during stop
+	monitorEnv     []string            // MONITOR_* variables from the unit which triggered OnFailure=/OnSuccess=
+	triggered      bool                // OnFailure=/OnSuccess= have been triggered for the current activation
 }
 
 type daemondef struct {
@@ -59,14 +78,32 @@ type daemondef struct {
 	After        map[string]*daemon
 	OnFailure    map[string]*daemon
 	OnSuccess    map[string]*daemon
+	OnFailureOf  map[string]*daemon
+	OnSuccessOf  map[string]*daemon
+	// propagation
+	PropagatesReloadTo   map[string]*daemon
+	ReloadPropagatedFrom map[string]*daemon
+	PropagatesStopTo     map[string]*daemon
+	StopPropagatedFrom   map[string]*daemon
 	// behaviour
-	StopWhenUnneeded bool
-	FailureAction    string
-	SuccessAction    string
+	StopWhenUnneeded        bool
+	OnFailureJobMode        string
+	OnSuccessJobMode        string
+	FailureAction           string
+	SuccessAction           string
+	FailureActionExitStatus int
+	SuccessActionExitStatus int
+	StartLimitInterval      time.Duration
+	StartLimitBurst         int
+	StartLimitAction        string
+	JobTimeout              time.Duration
+	JobTimeoutAction        string
+	Conditions              []condition // ConditionXXX= and AssertXXX=
 	// service section
 	ServiceType      string
 	RemainAfterExit  bool
 	PidFile          string
+	GuessMainPID     bool
 	ExecStart        []string
 	ExecStop         []string
 	ExecStartPre     []string
@@ -74,8 +111,9 @@ type daemondef struct {
 	ExecStopPre      []string
 	ExecStopPost     []string
 	ExecCondition    []string
-	ExecReload       string
+	ExecReload       []string
 	RestartSleep     time.Duration
+	StartTimeout     time.Duration
 	StopTimeout      time.Duration
 	Restart          string
 	WorkingDirectory string
@@ -83,6 +121,8 @@ type daemondef struct {
 	Group            string
 	Env              []string
 	EnvFile          []string
+	PassEnv          []string
+	UnsetEnv         []string
 	// rlimit
 	LimitCpu        string
 	LimitFsize      string
@@ -100,12 +140,27 @@ type daemondef struct {
 	LimitNice       string
 	LimitRtPrio     string
 	LimitRtTime     string
+	// install section
+	Installable     bool // WantedBy=, RequiredBy=, UpheldBy= or Alias= in [Install]
+	Alias           []string
+	Also            []string
+	DefaultInstance string
 }
 
 func (d *daemon) Name() string {
 	return d.name
 }
 
+// Description returns the Description= of the unit
+func (d *daemon) Description() string {
+	d.RLock()
+	defer d.RUnlock()
+	if d.def == nil {
+		return ""
+	}
+	return d.def.Description
+}
+
 func (d *daemon) isShuttingDown() bool {
 	if d.parent == nil {
 		return false
@@ -113,129 +168,79 @@ func (d *daemon) isShuttingDown() bool {
 	return d.parent.IsShuttingDown()
 }
 
-func (d *daemon) handleStopDeps() {
-	for depName, dep := range d.def.BoundBy {
-		err := dep.Stop()
-		if err != nil {
-			log.Printf("Failed to stop dependency %s: %s", depName, err)
-		}
-	}
-	for depName, dep := range d.def.ConsistsOf {
-		err := dep.Stop()
-		if err != nil {
-			log.Printf("Failed to stop dependency %s: %s", depName, err)
-		}
-	}
-}
-
-func (d *daemon) monitorNeeded() {
-	for {
-		time.Sleep(time.Second)
-		if d.State() == StateStopped {
-			break
-		}
-		if !d.def.StopWhenUnneeded {
-			continue
-		}
-		for _, dep := range d.def.WantedBy {
-			if dep.State() == StateRunning {
-				continue
-			}
-		}
-		for _, dep := range d.def.RequiredBy {
-			if dep.State() == StateRunning {
-				continue
-			}
-		}
-		for _, dep := range d.def.RequisiteOf {
-			if dep.State() == StateRunning {
-				continue
-			}
-		}
-		for _, dep := range d.def.BoundBy {
-			if dep.State() == StateRunning {
-				continue
-			}
-		}
-		for _, dep := range d.def.ConsistsOf {
-			if dep.State() == StateRunning {
-				continue
-			}
-		}
-		for _, dep := range d.def.UpheldBy {
-			if dep.State() == StateRunning {
-				continue
-			}
-		}
-		err := d.Stop()
-		if err != nil {
-			log.Printf("Failed to stop service as unneeded: %s: %s", d.Name(), err)
-		}
-		break
-	}
-}
-
+// monitorCmds waits for the processes started by ExecStart=, and for forking services the main processes they leave
+// behind, then records the result and restarts or deactivates the unit; the daemon lock is only held between waits
 func (d *daemon) monitorCmds(l *Logger) {
-	go d.monitorNeeded()
+	d.Lock()
 	d.pids = []int{}
+	cmds := d.cmds
+	serviceType := d.def.ServiceType
+	d.Unlock()
 	cmdpids := []int{}
 	var ans []*syscall.WaitStatus
-	for _, cmd := range d.cmds {
+	var pidFileErr error
+	for _, cmd := range cmds {
 		if cmd.Process != nil {
 			ans = append(ans, procwait.Wait(cmd.Process.Pid))
+			cmdpids = append(cmdpids, cmd.Process.Pid)
 		}
-		cmdpids = append(cmdpids, cmd.Process.Pid)
+	}
+	d.Lock()
+	if len(ans) > 0 {
+		d.exitStatus = ans[0]
 	}
 	d.cmds = []*exec.Cmd{}
-	if inslice.HasString([]string{"forking", "dbus", "notify", "notify-reload"}, d.def.ServiceType) {
-		if d.def.PidFile != "" {
-			npid, err := os.ReadFile(d.def.PidFile)
-			if err == nil {
-				pids := ""
-				for _, r := range npid {
-					if r >= '0' && r <= '9' {
-						pids += string(r)
-					}
+	d.Unlock()
+	if inslice.HasString([]string{"forking", "dbus", "notify", "notify-reload"}, serviceType) {
+		d.Lock()
+		pidFile := d.def.PidFile
+		guess := d.def.GuessMainPID
+		timeout := d.def.StartTimeout
+		invocationID := d.invocationID
+		d.Unlock()
+		if pidFile != "" {
+			pid, err := d.waitPidFile(pidFile, invocationID, cmdpids, timeout)
+			if err != nil {
+				log.Printf("<%s> %s", d.name, err)
+				pidFileErr = err
+			}
+			for pid > 0 {
+				d.Lock()
+				d.pids = []int{pid}
+				d.Unlock()
+				ws := procwait.Wait(pid)
+				// the main process may have been replaced, e.g. during reload, follow the PID file
+				if npid, err := readPidFile(pidFile, d.name, invocationID, cmdpids); err == nil && npid != pid {
+					log.Printf("<%s> Main PID changed: %d => %d", d.name, pid, npid)
+					pid = npid
+					continue
 				}
-				if pids != "" {
-					p, err := strconv.Atoi(pids)
-					if err == nil && p > 1 {
-						d.pids = []int{p}
-						ans = append(ans, procwait.Wait(p))
-						d.pids = []int{}
-					}
+				ans = append(ans, ws)
+				d.Lock()
+				d.pids = []int{}
+				if ws != nil {
+					d.exitStatus = ws
 				}
+				d.Unlock()
+				break
 			}
-		} else {
+		} else if guess {
 			for {
-				processList, err := ps.Processes()
-				if err != nil {
+				pids := guessMainPids(d.name, invocationID)
+				if len(pids) == 0 {
 					break
 				}
-				pids := []int{}
-				for _, p := range processList {
-					if p.PPid() != 1 {
-						continue
-					}
-					penviron, err := os.ReadFile("/proc/" + strconv.Itoa(p.Pid()) + "/environ")
-					if err == nil {
-						envs := strings.Split(string(penviron), string([]byte{0}))
-						for _, nenv := range envs {
-							if !strings.HasPrefix(nenv, "SYSTEMD_SERVICE_NAME=") {
-								continue
-							}
-							if strings.Split(nenv, "=")[1] == d.name {
-								pids = append(pids, p.Pid())
-							}
-						}
-					}
-				}
+				d.Lock()
 				d.pids = pids
-				for _, p := range pids {
-					ans = append(ans, procwait.Wait(p))
-				}
-				if len(pids) == 0 {
-					break
+				d.Unlock()
+				for i, p := range pids {
+					ws := procwait.Wait(p)
+					ans = append(ans, ws)
+					if i == 0 && ws != nil {
+						d.Lock()
+						d.exitStatus = ws
+						d.Unlock()
+					}
 				}
 			}
 		}
@@ -250,7 +255,9 @@ func (d *daemon) monitorCmds(l *Logger) {
 					}
 				}
 			}
+			d.Lock()
 			d.pids = kids
+			d.Unlock()
 			for _, c := range kids {
 				if rr := procwait.Wait(c); rr != nil {
 					found = true
@@ -261,140 +268,281 @@ func (d *daemon) monitorCmds(l *Logger) {
 				break
 			}
 		}
+		d.Lock()
 		d.pids = []int{}
+		d.Unlock()
 	}
 	defer l.Close()
-	actionType := d.def.SuccessAction
+	d.Lock()
+	// the first process which did not succeed determines the result
+	result := ResultSuccess
+	var exitErr error
 	for _, aa := range ans {
-		if aa != nil && aa.ExitStatus() != 0 {
-			actionType = d.def.FailureAction
+		if r := waitResult(aa); r != ResultSuccess {
+			result = r
+			exitErr = exitError(aa)
+			break
 		}
 	}
-	if strings.HasPrefix(actionType, "poweroff") {
-		procwait.Run(exec.Command("poweroff"))
-		return
+	if result == ResultSuccess && pidFileErr != nil {
+		result = ResultTimeout
+		exitErr = pidFileErr
 	}
-
+	failed := result != ResultSuccess
 	restart := d.def.Restart
-	if d.state == StateStopped || d.state == StateStopping || d.state == StateRestarting {
+	// when stopped or restarted explicitly, dependencies are handled by Stop() and Restart()
+	bySelf := !(d.state == StateStopped || d.state == StateStopping || d.state == StateRestarting)
+	if !bySelf {
 		restart = "no"
-	} else {
-		for _, dep := range d.def.UpheldBy {
-			if dep.State() == StateRunning {
-				restart = "always"
-			}
-		}
 	}
 	if d.def.RestartSleep == 0 {
 		d.def.RestartSleep = time.Second
 	}
-	switch restart {
-	case "always":
-		d.state = StateRestarting
-		time.Sleep(d.def.RestartSleep)
-		// Check if shutdown started during sleep
-		if d.isShuttingDown() || d.state == StateStopped {
-			return
+	d.Unlock()
+	if bySelf && len(d.upheldBy()) > 0 {
+		restart = "always"
+	}
+	d.Lock()
+	if exitErr != nil {
+		d.stateError = exitErr
+	}
+	willRestart := restarts(restart, result, d.def.RemainAfterExit)
+	if bySelf && !willRestart {
+		// the unit enters the failed state, or deactivates unless it remains active after exit; one which remains
+		// active triggers OnSuccess= once it is stopped
+		if failed {
+			d.runOnFailure(l)
+		} else if !d.def.RemainAfterExit {
+			d.runOnSuccess(l)
 		}
-		d.stateError = nil
-		for _, aa := range ans {
-			if aa != nil && aa.ExitStatus() != 0 {
-				log.Printf("<%s> Process exited with error code %d", d.name, aa.ExitStatus())
-			}
+	}
+	switch {
+	case willRestart:
+		if failed {
+			log.Printf("<%s> Main process failed: %s", d.name, exitErr)
 		}
-		if d.state == StateStopped {
+		log.Printf("Will restart %s in %v", d.name, d.def.RestartSleep)
+		d.result = result
+		d.nRestarts++
+		d.setState(SubStateAutoRestart)
+		sleep := d.def.RestartSleep
+		d.Unlock()
+		time.Sleep(sleep)
+		// Check if shutdown or an explicit stop happened during sleep
+		if d.isShuttingDown() || d.State() != StateRestarting {
 			return
 		}
-		err := d.start(d.isManual)
-		if err != nil {
+		log.Printf("Restarting %s", d.name)
+		d.Lock()
+		d.stateError = nil
+		isManual := d.isManual
+		d.Unlock()
+		if err := d.start(isManual); err != nil {
 			log.Printf("RESTART failed: %s", err)
-			return
+			d.stopDependents(false)
+			d.releaseDeps()
 		}
-	case "on-failure", "on-abnormal", "on-watchdog", "on-abort":
-		d.stateError = nil
-		for _, aa := range ans {
-			if aa != nil && aa.ExitStatus() != 0 {
-				d.stateError = fmt.Errorf("process exited with error code %d", aa.ExitStatus())
-			}
+	case !bySelf:
+		// the explicit stop or restart records the result
+		d.Unlock()
+	case !failed && d.def.RemainAfterExit:
+		d.setState(SubStateExited)
+		d.Unlock()
+	default:
+		d.deactivate(result)
+		d.isManual = false
+		d.Unlock()
+		d.stopDependents(false)
+		d.releaseDeps()
+	}
+}
+
+// runOnFailure starts the OnFailure= units, passing them the MONITOR_* variables, and carries out FailureAction=;
+// only once per activation; called with the daemon locked
+func (d *daemon) runOnFailure(*Logger) {
+	if d.triggered {
+		return
+	}
+	d.triggered = true
+	d.runAction("FailureAction", d.def.FailureAction, d.def.FailureActionExitStatus)
+	for ii, i := range d.def.OnFailure {
+		d.trigger("OnFailure", ii, i, d.def.OnFailureJobMode)
+	}
+}
+
+// runOnSuccess starts the OnSuccess= units, passing them the MONITOR_* variables, and carries out SuccessAction=;
+// only once per activation; called with the daemon locked
+func (d *daemon) runOnSuccess(*Logger) {
+	if d.triggered {
+		return
+	}
+	d.triggered = true
+	d.runAction("SuccessAction", d.def.SuccessAction, d.def.SuccessActionExitStatus)
+	for ii, i := range d.def.OnSuccess {
+		d.trigger("OnSuccess", ii, i, d.def.OnSuccessJobMode)
+	}
+}
+
+// setMonitorEnv passes the result of this unit to the triggered unit; called with the daemon locked
+func (d *daemon) setMonitorEnv(target *daemon) {
+	if target == d {
+		return
+	}
+	env := append(d.exitEnv("MONITOR_"), "MONITOR_INVOCATION_ID="+d.invocationID, "MONITOR_UNIT="+d.name+".service")
+	target.Lock()
+	target.monitorEnv = env
+	target.Unlock()
+}
+
+func (d *daemon) Start() error {
+	return d.start(true)
+}
+
+// runOneshot runs a oneshot ExecStart= command to completion, tracking it so that a stop request can terminate it;
+// the exit status is kept as the result of the unit
+func (d *daemon) runOneshot(cmd *exec.Cmd) (*syscall.WaitStatus, error) {
+	if err := procwait.Start(cmd); err != nil {
+		return nil, err
+	}
+	d.Lock()
+	d.cmds = []*exec.Cmd{cmd}
+	d.Unlock()
+	ws, err := procwait.Finish(cmd)
+	d.Lock()
+	d.cmds = []*exec.Cmd{}
+	if ws != nil {
+		d.exitStatus = ws
+	}
+	d.Unlock()
+	return ws, err
+}
+
+// mainPid returns the PID of the main process, or 0 if not known; called with the daemon locked
+func (d *daemon) mainPid() int {
+	if len(d.pids) > 0 && procwait.Is(d.pids[0]) {
+		return d.pids[0]
+	}
+	if len(d.cmds) > 0 && d.cmds[0].Process != nil && procwait.Is(d.cmds[0].Process.Pid) {
+		return d.cmds[0].Process.Pid
+	}
+	return 0
+}
+
+// unitPids returns the processes started by ExecStart= followed by the tracked main processes; called with the daemon locked
+func (d *daemon) unitPids() []int {
+	pids := []int{}
+	for _, cmd := range d.cmds {
+		if cmd.Process != nil {
+			pids = append(pids, cmd.Process.Pid)
 		}
-		if d.stateError != nil {
-			log.Printf("Will restart %s in %v", d.name, d.def.RestartSleep)
-			d.state = StateRestarting
-			time.Sleep(d.def.RestartSleep)
-			// Check if shutdown started during sleep
-			if d.isShuttingDown() || d.state == StateStopped {
-				return
-			}
-			log.Printf("Restarting %s", d.name)
-			err := d.start(d.isManual)
-			if err != nil {
-				log.Printf("RESTART failed: %s", err)
-				return
-			}
-		} else if d.stateError == nil && !d.def.RemainAfterExit {
-			d.state = StateStopped
-			d.isManual = false
-			d.handleStopDeps()
+	}
+	for _, pid := range d.pids {
+		if !inslice.HasInt(pids, pid) {
+			pids = append(pids, pid)
 		}
-	case "on-success":
-		d.stateError = nil
-		for _, aa := range ans {
-			if aa != nil && aa.ExitStatus() != 0 {
-				d.stateError = fmt.Errorf("process exited with error code %d", aa.ExitStatus())
-			}
+	}
+	return pids
+}
+
+// remainingPids returns the processes of the unit which have not exited yet; called with the daemon locked
+func (d *daemon) remainingPids() []int {
+	pids := []int{}
+	for _, pid := range d.unitPids() {
+		if procwait.Is(pid) {
+			pids = append(pids, pid)
 		}
-		if d.stateError == nil && !d.def.RemainAfterExit {
-			d.state = StateRestarting
-			time.Sleep(d.def.RestartSleep)
-			// Check if shutdown started during sleep
-			if d.isShuttingDown() || d.state == StateStopped {
-				return
-			}
-			err := d.start(d.isManual)
-			if err != nil {
-				log.Printf("RESTART failed: %s", err)
-				d.handleStopDeps()
-				return
+	}
+	return pids
+}
+
+// waitUnitExit waits up to the timeout for the processes of the unit, and the other given processes, to exit, and
+// reports whether they did
+func (d *daemon) waitUnitExit(tout time.Duration, others []int) bool {
+	waitStop := time.Now()
+	for {
+		time.Sleep(10 * time.Millisecond)
+		d.RLock()
+		exited := len(d.remainingPids()) == 0
+		d.RUnlock()
+		for _, pid := range others {
+			if procwait.Is(pid) {
+				exited = false
 			}
-		} else if d.stateError != nil {
-			d.state = StateStopped
-			d.isManual = false
-			d.handleStopDeps()
 		}
-	default:
-		for _, aa := range ans {
-			if aa != nil && aa.ExitStatus() != 0 {
-				d.stateError = fmt.Errorf("process exited with error code %d", aa.ExitStatus())
-			}
+		if exited {
+			return true
 		}
-		if !d.def.RemainAfterExit || d.stateError != nil {
-			d.state = StateStopped
-			d.isManual = false
-			d.handleStopDeps()
+		if time.Since(waitStop) > tout {
+			return false
 		}
 	}
 }
 
-func (d *daemon) runOnFailure(*Logger) {
-	for ii, i := range d.def.OnFailure {
-		err := i.start(false)
-		if err != nil {
-			log.Printf("<%s> OnFailure dependency %s start failed: %s", d.name, ii, err)
-		}
+// controlPid returns the PID of the running control process (ExecStartPre=, ExecStop=, ...), or 0; called with the daemon locked
+func (d *daemon) controlPid() int {
+	if d.control != nil && d.control.Process != nil {
+		return d.control.Process.Pid
 	}
+	return 0
 }
 
-func (d *daemon) runOnSuccess(*Logger) {
-	for ii, i := range d.def.OnSuccess {
-		err := i.start(false)
-		if err != nil {
-			log.Printf("<%s> OnSuccess dependency %s start failed: %s", d.name, ii, err)
+// abortControl terminates the control process, and the processes started by ExecStart= while starting, together with
+// their descendants, so that a canceled job does not wait for them to finish
+func (d *daemon) abortControl() {
+	d.Lock()
+	defer d.Unlock()
+	pids := []int{}
+	if pid := d.controlPid(); pid != 0 {
+		pids = append(pids, pid)
+	}
+	if d.state == StateStarting {
+		for _, cmd := range d.cmds {
+			if cmd.Process != nil {
+				pids = append(pids, cmd.Process.Pid)
+			}
 		}
 	}
+	for _, pid := range procDescendants(pids) {
+		syscall.Kill(pid, syscall.SIGTERM)
+	}
 }
 
-func (d *daemon) Start() error {
-	return d.start(true)
+// runControl runs a control process to completion, tracking it as ControlPID
+func (d *daemon) runControl(cmd *exec.Cmd) (*syscall.WaitStatus, error) {
+	if err := procwait.Start(cmd); err != nil {
+		return nil, err
+	}
+	d.Lock()
+	d.control = cmd
+	d.Unlock()
+	ws, err := procwait.Finish(cmd)
+	d.Lock()
+	d.control = nil
+	d.Unlock()
+	return ws, err
+}
+
+// newCmd prepares a command line for execution, with output going to the unit log stream
+func newCmd(line string, l *Logger, env []string) *exec.Cmd {
+	cmd := exec.Command("/bin/bash", "-c", line)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = l
+	cmd.Stderr = l
+	env = append([]string{}, env...)
+	if stream, id, err := l.Stream(); err == nil {
+		cmd.Stdout = stream
+		cmd.Stderr = stream
+		env = envSet(env, "JOURNAL_STREAM="+id)
+	}
+	cmd.Env = env
+	return cmd
+}
+
+// newInvocationID returns a random 128-bit ID in the format used for INVOCATION_ID
+func newInvocationID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
 }
 
 func (d *daemon) startCheckAbortState() error {
@@ -408,13 +556,30 @@ func (d *daemon) startCheckAbortState() error {
 	if abortState {
 		return fmt.Errorf("START: %s aborted by stop signal", dName)
 	}
+	if d.parent != nil {
+		if j := d.parent.runningJob(d); j != nil && j.isCanceled() {
+			return fmt.Errorf("START: %s aborted, job canceled", dName)
+		}
+	}
 	return nil
 }
 
 func (d *daemon) start(isManual bool) error {
+	return d.startUnit(isManual, false)
+}
+
+// startUnit starts the unit; with ignoreDeps, the requirement dependencies are neither started nor checked, as for
+// the ignore-dependencies and ignore-requirements job modes
+func (d *daemon) startUnit(isManual bool, ignoreDeps bool) error {
 	if d == nil {
 		return nil
 	}
+	// dependencies pulled in by a start which did not succeed are released again
+	defer func() {
+		if d.State() == StateStopped {
+			d.releaseDeps()
+		}
+	}()
 
 	// Check if shutdown is in progress before starting
 	if d.isShuttingDown() {
@@ -438,6 +603,10 @@ func (d *daemon) start(isManual bool) error {
 		d.Unlock()
 		return errors.New("service is masked")
 	}
+	if err := d.loadError(); err != nil {
+		d.Unlock()
+		return err
+	}
 	if d.def.LimitCpu != "" {
 		log.Printf("<%s> WARNING: LimitCPU=%s specified in service file, cannot set in docker", d.name, d.def.LimitCpu)
 	}
@@ -493,12 +662,31 @@ func (d *daemon) start(isManual bool) error {
 		d.Unlock()
 		return nil
 	}
-	if d.state != StateRestarting {
-		d.state = StateStarting
+	if d.startLimitHit() {
+		d.deactivate(ResultStartLimitHit)
+		d.stateError = errors.New("start request repeated too quickly, refusing to start")
+		log.Printf("<%s> Start request repeated too quickly", d.name)
+		d.runAction("StartLimitAction", d.def.StartLimitAction, -1)
+		d.Unlock()
+		return d.stateError
 	}
-	if d.def.ServiceType == "oneshot" {
-		d.def.RemainAfterExit = true
+	if jt := d.def.JobTimeout; jt > 0 && jt != infinity {
+		action := d.def.JobTimeoutAction
+		timer := time.AfterFunc(jt, func() {
+			d.Lock()
+			timedOut := d.state == StateStarting || d.state == StateRestarting
+			if timedOut {
+				log.Printf("<%s> Start job timed out", d.name)
+				d.runAction("JobTimeoutAction", action, -1)
+			}
+			d.Unlock()
+			if timedOut && d.parent != nil {
+				d.parent.abortJob(d)
+			}
+		})
+		defer timer.Stop()
 	}
+	d.setState(SubStateCondition)
 	d.Unlock()
 	if err := d.startCheckAbortState(); err != nil {
 		return err
@@ -508,31 +696,35 @@ func (d *daemon) start(isManual bool) error {
 		return nerr
 	}
 	d.Lock()
+	if d.state == StateStopped {
+		// the cleanup leaves the unit stopped; it is still starting, so that dependency loops do not start it again
+		d.setState(SubStateCondition)
+	}
 	if err != nil {
-		d.state = StateStopped
+		d.deactivate(ResultResources)
 		d.stateError = err
 		d.Unlock()
 		return fmt.Errorf("could not cleanup old run jobs: %s", err)
 	}
 	d.stateError = nil
-	denv := append(os.Environ(), d.def.Env...)
-	for _, ef := range d.def.EnvFile {
-		failOnNotFound := true
-		if strings.HasPrefix(ef, "-") {
-			failOnNotFound = false
-			ef = strings.TrimPrefix(ef, "-")
-		}
-		ct, err := os.ReadFile(ef)
-		if err != nil {
-			if failOnNotFound {
-				d.Unlock()
-				return fmt.Errorf("env file %s not found: %s", ef, err)
-			} else {
-				continue
-			}
-		}
-		denv = append(denv, strings.Split(string(ct), "\n")...)
+	d.conditionError = nil
+	d.exitStatus = nil
+	d.result = ResultSuccess
+	d.stopTimedOut = false
+	d.triggered = false
+	d.invocationID = newInvocationID()
+	d.env, err = d.environment()
+	if err != nil {
+		d.deactivate(ResultResources)
+		d.stateError = err
+		d.Unlock()
+		return err
+	}
+	for _, kv := range d.monitorEnv {
+		d.env = envSet(d.env, kv)
 	}
+	d.monitorEnv = nil
+	denv := d.execEnv()
 	var uid, gid int64
 	if d.def.User != "" {
 		u, err := user.Lookup(d.def.User)
@@ -561,143 +753,185 @@ func (d *daemon) start(isManual bool) error {
 	}
 	l, err := NewLogger(d.name)
 	if err != nil {
-		d.state = StateStopped
+		d.deactivate(ResultResources)
 		d.stateError = err
 		d.Unlock()
 		return fmt.Errorf("could not open log file: %s", err)
 	}
 	execCondition := make([]string, len(d.def.ExecCondition))
 	copy(execCondition, d.def.ExecCondition)
+	conditions := make([]condition, len(d.def.Conditions))
+	copy(conditions, d.def.Conditions)
 	d.Unlock()
+	menv := d.managerEnvironment()
+	if failed := checkConditions(conditions, false, menv); len(failed) > 0 {
+		d.Lock()
+		defer d.Unlock()
+		d.deactivate(ResultSuccess)
+		d.stateError = nil
+		d.conditionError = conditionsFailedError(failed)
+		log.Printf("<%s> Condition check resulted in start being skipped: %s", d.name, d.conditionError)
+		l.Close()
+		return nil
+	}
+	if failed := checkConditions(conditions, true, menv); len(failed) > 0 {
+		d.Lock()
+		defer d.Unlock()
+		d.deactivate(ResultSuccess)
+		d.stateError = fmt.Errorf("assertion failed: %s", conditionsFailedError(failed))
+		log.Printf("<%s> Assertion failed: %s", d.name, conditionsFailedError(failed))
+		l.Close()
+		return d.stateError
+	}
 	for _, line := range execCondition {
 		if err := d.startCheckAbortState(); err != nil {
 			return err
 		}
-		cmd := exec.Command("/bin/bash", "-c", line)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = l
-		cmd.Stderr = l
-		cmd.Env = denv
-		pstate, err := procwait.Run(cmd)
-		if err != nil {
+		cmd := newCmd(line, l, denv)
+		pstate, err := d.runControl(cmd)
+		if aerr := d.startCheckAbortState(); aerr != nil {
+			return aerr
+		}
+		// exit codes 1-254 skip the start, 255, a signal or failure to execute are a failure
+		if pstate == nil || pstate.Signaled() || pstate.ExitStatus() == 255 {
 			d.Lock()
 			defer d.Unlock()
-			d.state = StateStopped
-			d.stateError = nil
-			log.Printf("<%s> Condition %s not met", d.name, line)
+			d.deactivate(failResult(pstate))
+			d.exitStatus = pstate
+			d.stateError = fmt.Errorf("<%s> Failed ExecCondition: %s: %s", d.name, line, err)
+			log.Printf("<%s> Condition %s failed: %s", d.name, line, err)
 			l.Close()
-			return nil
+			d.runOnFailure(l)
+			return d.stateError
 		}
 		if pstate.ExitStatus() != 0 {
 			d.Lock()
 			defer d.Unlock()
-			d.state = StateStopped
+			d.deactivate(ResultSuccess)
 			d.stateError = nil
+			d.conditionError = fmt.Errorf("ExecCondition=%s exited with status %d", line, pstate.ExitStatus())
 			log.Printf("<%s> Condition %s not met (returned %d)", d.name, line, pstate.ExitStatus())
 			l.Close()
 			return nil
 		}
 	}
+	// dependencies are skipped when ignored by the job mode
+	depList := func(deps map[string]*daemon) map[string]*daemon {
+		if ignoreDeps {
+			return nil
+		}
+		return maps.Clone(deps)
+	}
 	d.Lock()
-	requirement := maps.Clone(d.def.Requisite)
+	requirement := depList(d.def.Requisite)
 	d.Unlock()
 	for ii, i := range requirement {
 		if err := d.startCheckAbortState(); err != nil {
 			return err
 		}
-		if i.State() != StateRunning {
-			log.Printf("<%s> Dependency %s not running, aborting: %s", d.name, ii, err)
+		if i == nil && missingDep(ii) == nil {
+			continue
+		}
+		if i == nil || i.State() != StateRunning {
+			log.Printf("<%s> Dependency %s not running, aborting", d.name, ii)
 			l.Close()
 			d.Lock()
 			defer d.Unlock()
-			d.state = StateStopped
-			d.stateError = fmt.Errorf("%s: %s", i.Name(), err)
-			d.runOnFailure(l)
-			return err
+			// a dependency which is not there fails the start job, but not the unit, so OnFailure= is not triggered
+			d.deactivate(ResultSuccess)
+			d.stateError = fmt.Errorf("requisite %s not running", ii)
+			if i == nil {
+				d.stateError = missingDep(ii)
+			}
+			return d.stateError
 		}
 	}
 	d.Lock()
-	requirement = maps.Clone(d.def.Requires)
+	requirement = depList(d.def.Requires)
 	d.Unlock()
 	for ii, i := range requirement {
 		if err := d.startCheckAbortState(); err != nil {
 			return err
 		}
-		err := i.start(false)
+		err := d.dependencyJob(i, "start")
+		if i == nil {
+			err = missingDep(ii)
+		}
 		if err != nil {
 			log.Printf("<%s> Dependency %s start failed, aborting: %s", d.name, ii, err)
 			l.Close()
 			d.Lock()
 			defer d.Unlock()
-			d.state = StateStopped
-			d.stateError = fmt.Errorf("%s: %s", i.Name(), err)
-			d.runOnFailure(l)
+			d.deactivate(ResultSuccess)
+			d.stateError = fmt.Errorf("%s: %s", ii, err)
 			return err
 		}
 	}
 	d.Lock()
-	requirement = maps.Clone(d.def.BindsTo)
+	requirement = depList(d.def.BindsTo)
 	d.Unlock()
 	for ii, i := range requirement {
 		if err := d.startCheckAbortState(); err != nil {
 			return err
 		}
-		err := i.start(false)
+		err := d.dependencyJob(i, "start")
+		if i == nil {
+			err = missingDep(ii)
+		}
 		if err != nil {
 			log.Printf("<%s> Dependency %s start failed, aborting: %s", d.name, ii, err)
 			l.Close()
 			d.Lock()
 			defer d.Unlock()
-			d.state = StateStopped
-			d.stateError = fmt.Errorf("%s: %s", i.Name(), err)
-			d.runOnFailure(l)
+			d.deactivate(ResultSuccess)
+			d.stateError = fmt.Errorf("%s: %s", ii, err)
 			return err
 		}
 	}
 	d.Lock()
-	requirement = maps.Clone(d.def.Wants)
+	requirement = depList(d.def.Wants)
 	d.Unlock()
 	for ii, i := range requirement {
 		if err := d.startCheckAbortState(); err != nil {
 			return err
 		}
-		err := i.start(false)
+		err := d.dependencyJob(i, "start")
 		if err != nil {
 			log.Printf("<%s> Dependency %s start failed: %s", d.name, ii, err)
 		}
 	}
 	d.Lock()
-	requirement = maps.Clone(d.def.Upholds)
+	requirement = depList(d.def.Upholds)
 	d.Unlock()
 	for ii, i := range requirement {
 		if err := d.startCheckAbortState(); err != nil {
 			return err
 		}
-		err := i.start(false)
+		err := d.dependencyJob(i, "start")
 		if err != nil {
 			log.Printf("<%s> Dependency %s start failed: %s", d.name, ii, err)
 		}
 	}
 	d.Lock()
-	requirement = maps.Clone(d.def.Conflicts)
+	requirement = depList(d.def.Conflicts)
 	d.Unlock()
 	for ii, i := range requirement {
 		if err := d.startCheckAbortState(); err != nil {
 			return err
 		}
-		err := i.Stop()
+		err := d.dependencyJob(i, "stop")
 		if err != nil {
 			log.Printf("<%s> Dependency %s stop failed, aborting: %s", d.name, ii, err)
 			l.Close()
 			d.Lock()
 			defer d.Unlock()
-			d.state = StateStopped
+			d.deactivate(ResultSuccess)
 			d.stateError = fmt.Errorf("%s: %s", i.Name(), err)
-			d.runOnFailure(l)
 			return err
 		}
 	}
 	d.Lock()
+	d.setStage(SubStateStartPre)
 	execCondition = make([]string, len(d.def.ExecStartPre))
 	copy(execCondition, d.def.ExecStartPre)
 	d.Unlock()
@@ -710,19 +944,21 @@ func (d *daemon) start(isManual bool) error {
 			failOnErr = false
 			line = strings.TrimPrefix(line, "-")
 		}
-		cmd := exec.Command("/bin/bash", "-c", line)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = l
-		cmd.Stderr = l
-		cmd.Env = denv
-		_, err := procwait.Run(cmd)
+		cmd := newCmd(line, l, denv)
+		ws, err := d.runControl(cmd)
 		if err != nil {
+			if aerr := d.startCheckAbortState(); aerr != nil {
+				return aerr
+			}
 			log.Printf("<%s> Failed: %s: %s", d.name, line, err)
 			if failOnErr {
-				d.Stop()
+				d.Lock()
+				d.exitStatus = ws
+				d.Unlock()
+				d.stop(true)
 				d.Lock()
 				defer d.Unlock()
-				d.state = StateStopped
+				d.deactivate(failResult(d.exitStatus))
 				d.stateError = fmt.Errorf("<%s> Failed StartPre: %s: %s", d.name, line, err)
 				l.Close()
 				d.runOnFailure(l)
@@ -731,8 +967,11 @@ func (d *daemon) start(isManual bool) error {
 		}
 	}
 	d.Lock()
+	d.setStage(SubStateStart)
 	execCondition = make([]string, len(d.def.ExecStart))
 	copy(execCondition, d.def.ExecStart)
+	oneshot := d.def.ServiceType == "oneshot"
+	workDir := d.def.WorkingDirectory
 	d.Unlock()
 	cmds := []*exec.Cmd{}
 	for _, line := range execCondition {
@@ -744,38 +983,66 @@ func (d *daemon) start(isManual bool) error {
 			failOnErr = false
 			line = strings.TrimPrefix(line, "-")
 		}
-		cmd := exec.Command("/bin/bash", "-c", line)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = l
-		cmd.Stderr = l
-		cmd.Env = append(denv, "SYSTEMD_SERVICE_NAME="+d.name)
+		cmd := newCmd(line, l, append(denv, "SYSTEMD_SERVICE_NAME="+d.name))
 		if uid != 0 {
 			cmd.SysProcAttr = &syscall.SysProcAttr{}
 			cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
 		}
-		if d.def.WorkingDirectory != "" {
-			cmd.Dir = d.def.WorkingDirectory
+		if workDir != "" {
+			cmd.Dir = workDir
+		}
+		if oneshot {
+			// oneshot commands run one after the other, the first failure aborts the start
+			ws, err := d.runOneshot(cmd)
+			if err != nil {
+				if aerr := d.startCheckAbortState(); aerr != nil {
+					return aerr
+				}
+				log.Printf("<%s> Failed: %s: %s", d.name, line, err)
+				if failOnErr {
+					d.Lock()
+					d.exitStatus = ws
+					d.Unlock()
+					d.stop(true)
+					d.Lock()
+					defer d.Unlock()
+					d.deactivate(failResult(d.exitStatus))
+					d.stateError = fmt.Errorf("<%s> Failed Start: %s: %s", d.name, line, err)
+					l.Close()
+					d.runOnFailure(l)
+					return err
+				}
+			}
+			continue
 		}
 		err := cmd.Start()
 		if err != nil {
 			log.Printf("<%s> Failed: %s: %s", d.name, line, err)
 			if failOnErr {
-				d.Stop()
+				d.stop(true)
 				d.Lock()
 				defer d.Unlock()
-				d.state = StateStopped
+				d.deactivate(failResult(d.exitStatus))
 				d.stateError = fmt.Errorf("<%s> Failed Start: %s: %s", d.name, line, err)
 				l.Close()
 				d.runOnFailure(l)
 				return err
 			}
+			continue
 		}
 		cmds = append(cmds, cmd)
 	}
 	d.Lock()
+	d.setStage(SubStateStartPost)
+	// tracked from here on, so that an aborted start stops them
+	d.cmds = cmds
 	execCondition = make([]string, len(d.def.ExecStartPost))
 	copy(execCondition, d.def.ExecStartPost)
 	d.Unlock()
+	postEnv := denv
+	if len(cmds) > 0 && cmds[0].Process != nil {
+		postEnv = append(postEnv, "MAINPID="+strconv.Itoa(cmds[0].Process.Pid))
+	}
 	for _, line := range execCondition {
 		if err := d.startCheckAbortState(); err != nil {
 			return err
@@ -785,19 +1052,21 @@ func (d *daemon) start(isManual bool) error {
 			failOnErr = false
 			line = strings.TrimPrefix(line, "-")
 		}
-		cmd := exec.Command("/bin/bash", "-c", line)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = l
-		cmd.Stderr = l
-		cmd.Env = denv
-		_, err := procwait.Run(cmd)
+		cmd := newCmd(line, l, postEnv)
+		ws, err := d.runControl(cmd)
 		if err != nil {
+			if aerr := d.startCheckAbortState(); aerr != nil {
+				return aerr
+			}
 			log.Printf("<%s> Failed: %s: %s", d.name, line, err)
 			if failOnErr {
-				d.Stop()
+				d.Lock()
+				d.exitStatus = ws
+				d.Unlock()
+				d.stop(true)
 				d.Lock()
 				defer d.Unlock()
-				d.state = StateStopped
+				d.deactivate(failResult(d.exitStatus))
 				d.stateError = fmt.Errorf("<%s> Failed StartPost: %s: %s", d.name, line, err)
 				l.Close()
 				d.runOnFailure(l)
@@ -806,13 +1075,31 @@ func (d *daemon) start(isManual bool) error {
 		}
 	}
 	d.Lock()
-	defer d.Unlock()
 	if d.state == StateStopping {
+		d.Unlock()
 		return errors.New("aborting, state changed to stopping")
 	}
-	d.state = StateRunning
 	d.stateError = nil
-	d.runOnSuccess(l)
+	if oneshot && !d.def.RemainAfterExit {
+		// the last ExecStart= succeeded, the service deactivates without having become active
+		d.deactivate(ResultSuccess)
+		d.isManual = false
+		d.runOnSuccess(l)
+		d.Unlock()
+		l.Close()
+		d.stopDependents(false)
+		d.releaseDeps()
+		return nil
+	}
+	defer d.Unlock()
+	if len(cmds) == 0 && d.def.RemainAfterExit {
+		d.setState(SubStateExited)
+	} else {
+		d.setState(SubStateRunning)
+	}
+	if d.parent != nil {
+		d.parent.started(d)
+	}
 	d.cmds = cmds
 	go d.monitorCmds(l)
 	return nil
@@ -822,7 +1109,28 @@ func (d *daemon) Stop() error {
 	if d == nil {
 		return nil
 	}
-	return d.stop(true)
+	d.Lock()
+	wasActive := isActive(d.state)
+	if wasActive {
+		// marked first, so that dependency loops do not propagate the stop back to this unit
+		d.setState(SubStateStop)
+	}
+	d.Unlock()
+	d.stopDependents(true)
+	err := d.stop(true)
+	d.Lock()
+	d.isManual = false
+	if wasActive && !d.isShuttingDown() {
+		if d.serviceResult() == "success" {
+			d.runOnSuccess(nil)
+		} else {
+			d.runOnFailure(nil)
+		}
+	}
+	d.Unlock()
+	d.releaseDeps()
+	d.uphold()
+	return err
 }
 
 func (d *daemon) stop(printStopping bool) error {
@@ -839,7 +1147,20 @@ func (d *daemon) stop(printStopping bool) error {
 		return errors.New("service is masked")
 	}
 	if d.state != StateRestarting || printStopping {
-		d.state = StateStopping
+		d.setState(SubStateStop)
+	}
+	if pid := d.controlPid(); pid != 0 && printStopping {
+		// a start in progress is aborted by terminating its control process, and given a moment to notice
+		log.Printf("Sending SIGTERM to control process %d", pid)
+		syscall.Kill(pid, syscall.SIGTERM)
+		d.Unlock()
+		for i := 0; i < 500; i++ {
+			time.Sleep(10 * time.Millisecond)
+			if d.ControlPID() != pid {
+				break
+			}
+		}
+		d.Lock()
 	}
 	l, err := NewLogger(d.name)
 	if err != nil {
@@ -847,15 +1168,14 @@ func (d *daemon) stop(printStopping bool) error {
 		d.stateError = err
 		return fmt.Errorf("could not open log file: %s", err)
 	}
+	defer l.Close()
 	cmdLine := make([]string, len(d.def.ExecStopPre))
 	copy(cmdLine, d.def.ExecStopPre)
+	env := d.execEnv(d.mainPidEnv()...)
 	d.Unlock()
 	for _, line := range cmdLine {
-		cmd := exec.Command("/bin/bash", "-c", line)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = l
-		cmd.Stderr = l
-		_, err := procwait.Run(cmd)
+		cmd := newCmd(line, l, env)
+		_, err := d.runControl(cmd)
 		if err != nil {
 			d.Lock()
 			d.stateError = fmt.Errorf("<%s> Failed StopPre: %s: %s", d.name, line, err)
@@ -867,16 +1187,14 @@ func (d *daemon) stop(printStopping bool) error {
 	cmdLine = make([]string, len(d.def.ExecStop))
 	copy(cmdLine, d.def.ExecStop)
 	workDir := d.def.WorkingDirectory
+	env = d.execEnv(append(d.mainPidEnv(), d.exitEnv("")...)...)
 	d.Unlock()
 	for _, line := range cmdLine {
-		cmd := exec.Command("/bin/bash", "-c", line)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = l
-		cmd.Stderr = l
+		cmd := newCmd(line, l, env)
 		if workDir != "" {
 			cmd.Dir = workDir
 		}
-		_, err := procwait.Run(cmd)
+		_, err := d.runControl(cmd)
 		if err != nil {
 			d.Lock()
 			d.stateError = fmt.Errorf("<%s> Failed Stop: %s: %s", d.name, line, err)
@@ -885,25 +1203,49 @@ func (d *daemon) stop(printStopping bool) error {
 		}
 	}
 	d.Lock()
-	for _, cmd := range d.cmds {
-		if cmd.Process != nil {
-			log.Printf("Sending SIGTERM to %d", cmd.Process.Pid)
-			syscall.Kill(cmd.Process.Pid, syscall.SIGTERM)
+	d.setStage(SubStateStopSigterm)
+	hadMain := d.mainPid() != 0
+	// the process tree is remembered, so that children left behind by the main process are found after ExecStopPost=
+	tree := procDescendants(d.unitPids())
+	for _, pid := range d.unitPids() {
+		log.Printf("Sending SIGTERM to %d", pid)
+		syscall.Kill(pid, syscall.SIGTERM)
+	}
+	tout := defaultStopTimeout
+	if d.def.StopTimeout != 0 {
+		tout = d.def.StopTimeout
+	}
+	d.Unlock()
+	exited := d.waitUnitExit(tout, nil)
+	d.Lock()
+	if !exited {
+		d.setStage(SubStateStopSigkill)
+		for _, pid := range d.unitPids() {
+			syscall.Kill(pid, syscall.SIGKILL)
 		}
+		d.stateError = errors.New("failed to exit using SIGTERM, applied SIGKILL")
+		d.stopTimedOut = true
+	}
+	d.Unlock()
+	// give the monitor a moment to collect the exit status of the main process for ExecStopPost=
+	for i := 0; hadMain && i < 100; i++ {
+		d.RLock()
+		collected := d.exitStatus != nil
+		d.RUnlock()
+		if collected {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
+	d.Lock()
+	d.setStage(SubStateStopPost)
 	cmdLine = make([]string, len(d.def.ExecStopPost))
 	copy(cmdLine, d.def.ExecStopPost)
-	tout := 5 * time.Second
-	if d.def.StopTimeout != 0 {
-		tout = d.def.StopTimeout
-	}
+	env = d.execEnv(d.exitEnv("")...)
 	d.Unlock()
 	for _, line := range cmdLine {
-		cmd := exec.Command("/bin/bash", "-c", line)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = l
-		cmd.Stderr = l
-		_, err := procwait.Run(cmd)
+		cmd := newCmd(line, l, env)
+		_, err := d.runControl(cmd)
 		if err != nil {
 			d.Lock()
 			d.stateError = fmt.Errorf("<%s> Failed StopPost: %s: %s", d.name, line, err)
@@ -911,40 +1253,36 @@ func (d *daemon) stop(printStopping bool) error {
 			d.Unlock()
 		}
 	}
-	exited := true
-	waitStop := time.Now()
-	for {
-		exited = true
-		time.Sleep(10 * time.Millisecond)
-		d.Lock()
-		for _, cmd := range d.cmds {
-			if procwait.Is(cmd.Process.Pid) {
-				exited = false
-				break
-			}
+	d.Lock()
+	// processes left over after ExecStopPost= get another SIGTERM, and SIGKILL if they do not exit in time
+	left := procDescendants(append(d.remainingPids(), tree...))
+	if len(left) > 0 {
+		d.setStage(SubStateFinalSigterm)
+		for _, pid := range left {
+			log.Printf("Sending SIGTERM to remaining process %d", pid)
+			syscall.Kill(pid, syscall.SIGTERM)
 		}
 		d.Unlock()
-		if exited {
-			break
-		}
-		if time.Since(waitStop) > tout {
-			break
+		exited = d.waitUnitExit(tout, left)
+		d.Lock()
+		if !exited {
+			for _, pid := range procDescendants(append(d.remainingPids(), left...)) {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+			d.stateError = errors.New("remaining processes failed to exit using SIGTERM, applied SIGKILL")
+			d.stopTimedOut = true
 		}
 	}
-	d.Lock()
 	defer d.Unlock()
-	if !exited {
-		for _, cmd := range d.cmds {
-			if cmd.Process != nil {
-				syscall.Kill(cmd.Process.Pid, syscall.SIGKILL)
-			}
-		}
-		d.stateError = errors.New("failed to exit using SIGTERM, applied SIGKILL")
+	if d.stopTimedOut {
+		d.deactivate(ResultTimeout)
+	} else {
+		d.deactivate(waitResult(d.exitStatus))
 	}
-	d.state = StateStopped
 	return nil
 }
 
+// Restart stops and starts the unit, then restarts the active units with Requires=, Requisite=, BindsTo= or PartOf= on it
 func (d *daemon) Restart() error {
 	d.Lock()
 	if d.isMasked {
@@ -956,22 +1294,23 @@ func (d *daemon) Restart() error {
 		defer d.Unlock()
 		return fmt.Errorf("service %s is in a state from which restart cannot run", d.name)
 	}
-	d.state = StateRestarting
+	deps := d.depUnits(d.def.RequiredBy, d.def.RequisiteOf, d.def.BoundBy, d.def.ConsistsOf)
+	d.setState(SubStateStop)
 	d.Unlock()
-	err := d.Stop()
+	deps = activeUnits(deps)
+	err := d.stop(true)
 	if err != nil {
 		return err
 	}
-	d.Lock()
-	abortState := d.state == StateStopping
-	dName := d.name
-	d.Unlock()
-	if abortState {
-		return fmt.Errorf("START: %s aborted by stop signal", dName)
+	if err := d.startCheckAbortState(); err != nil {
+		return err
 	}
-	return d.Start()
+	err = d.Start()
+	d.restartDependents(deps)
+	return err
 }
 
+// Reload reloads the unit, then the units it propagates reloads to
 func (d *daemon) Reload() error {
 	d.Lock()
 	if d.isMasked {
@@ -983,40 +1322,88 @@ func (d *daemon) Reload() error {
 		defer d.Unlock()
 		return fmt.Errorf("service %s is in a state from which restart cannot run", d.name)
 	}
-	execReload := d.def.ExecReload
+	cmdLine := make([]string, len(d.def.ExecReload))
+	copy(cmdLine, d.def.ExecReload)
+	workDir := d.def.WorkingDirectory
+	env := d.execEnv(d.mainPidEnv()...)
+	sub := d.subState
+	d.setState(SubStateReload)
 	d.Unlock()
-	if execReload != "" {
-		var buf bytes.Buffer
-		cmd := exec.Command("/bin/bash", "-c", execReload)
-		cmd.Stdout = &buf
-		cmd.Stderr = &buf
-		_, err := procwait.Run(cmd)
-		out := buf.Bytes()
+	// the unit returns to running, or exited, unless it was stopped in the meantime
+	defer func() {
+		d.Lock()
+		if d.subState == SubStateReload {
+			d.setState(sub)
+		}
+		d.Unlock()
+	}()
+	if len(cmdLine) > 0 {
+		l, err := NewLogger(d.name)
 		if err != nil {
-			return fmt.Errorf("failed reload: %s: %s", err, string(out))
+			return fmt.Errorf("could not open log file: %s", err)
+		}
+		defer l.Close()
+		for _, line := range cmdLine {
+			cmd := newCmd(line, l, env)
+			if workDir != "" {
+				cmd.Dir = workDir
+			}
+			if _, err := d.runControl(cmd); err != nil {
+				log.Printf("<%s> Failed to run Reload action (%s): %s", d.name, line, err)
+				return fmt.Errorf("failed reload: %s: %s", line, err)
+			}
 		}
 	} else {
 		d.Lock()
-		defer d.Unlock()
-		for _, cmd := range d.cmds {
-			syscall.Kill(cmd.Process.Pid, syscall.SIGHUP)
+		for _, pid := range d.unitPids() {
+			syscall.Kill(pid, syscall.SIGHUP)
 		}
+		d.Unlock()
 	}
+	d.rereadPidFile()
+	d.reloadPropagated()
 	return nil
 }
 
-func (d *daemon) IsEnabled() bool {
-	d.Lock()
-	defer d.Unlock()
-	target := "/etc/systemd/system/multi-user.target.wants"
-	if d.def == nil {
-		return false
+// Kill sends the signal to the main process, the control process, or all processes of the unit including their
+// descendants, without changing the state of the unit; whom is main, control or all
+func (d *daemon) Kill(whom string, sig syscall.Signal) error {
+	d.RLock()
+	pids := []int{}
+	switch whom {
+	case "main":
+		if pid := d.mainPid(); pid != 0 {
+			pids = append(pids, pid)
+		}
+	case "control":
+		if pid := d.controlPid(); pid != 0 {
+			pids = append(pids, pid)
+		}
+	default:
+		pids = d.unitPids()
+		if pid := d.controlPid(); pid != 0 {
+			pids = append(pids, pid)
+		}
+		pids = procDescendants(pids)
 	}
-	serviceDest := path.Join(target, d.name+".service")
-	if _, err := os.Stat(serviceDest); err != nil {
-		return false
+	d.RUnlock()
+	if len(pids) == 0 {
+		switch whom {
+		case "main":
+			return errors.New("No main process to kill")
+		case "control":
+			return errors.New("No control process to kill")
+		}
+		return errors.New("No matching processes to kill")
+	}
+	errs := []error{}
+	for _, pid := range pids {
+		log.Printf("<%s> Sending signal %s to %d", d.name, signalName(sig), pid)
+		if err := syscall.Kill(pid, sig); err != nil {
+			errs = append(errs, fmt.Errorf("failed to send signal %s to process %d: %s", signalName(sig), pid, err))
+		}
 	}
-	return true
+	return errors.Join(errs...)
 }
 
 func (d *daemon) CreateInstance(name string) error {
@@ -1047,7 +1434,7 @@ func (d *daemon) DeleteService() error {
 func (d *daemon) Enable() error {
 	d.Lock()
 	defer d.Unlock()
-	target := "/etc/systemd/system/multi-user.target.wants"
+	target := bootWantsDir(localUnitPath)
 	if _, err := os.Stat(target); err != nil {
 		os.MkdirAll(target, 0755)
 	}
@@ -1070,7 +1457,7 @@ func (d *daemon) Enable() error {
 func (d *daemon) Disable() error {
 	d.Lock()
 	defer d.Unlock()
-	target := "/etc/systemd/system/multi-user.target.wants"
+	target := bootWantsDir(localUnitPath)
 	serviceDest := path.Join(target, d.name+".service")
 	if _, err := os.Stat(serviceDest); err == nil {
 		err = os.Remove(serviceDest)
@@ -1088,7 +1475,7 @@ func (d *daemon) Mask() error {
 	if _, err := os.Stat(target); err == nil {
 		return fmt.Errorf("masking failed: %s exists", target)
 	}
-	err := os.Symlink("/dev/null", "target")
+	err := os.Symlink("/dev/null", target)
 	if err != nil {
 		return err
 	}
@@ -1122,42 +1509,46 @@ func (d *daemon) State() DaemonState {
 	return d.state
 }
 
-func (d *daemon) Detail() string {
+// LoadState returns whether the unit file was loaded successfully
+func (d *daemon) LoadState() LoadState {
 	d.RLock()
-	w, _ := yaml.Marshal(d.def)
-	d.RUnlock()
-	s := string(w)
-	s = s + fmt.Sprintf("Masked: %t\n", d.isMasked)
-	return s
+	defer d.RUnlock()
+	if d.isMasked {
+		return LoadStateMasked
+	}
+	return d.loadState
 }
 
-func (d *daemon) Status() (string, error) {
+// LoadMessages returns the diagnostics recorded while loading the unit files
+func (d *daemon) LoadMessages() []string {
 	d.RLock()
 	defer d.RUnlock()
-	msg := "State: "
-	switch d.state {
-	case StateRestarting:
-		msg += "Restarting"
-	case StateRunning:
-		pids := []string{}
-		for _, cmd := range d.cmds {
-			pids = append(pids, strconv.Itoa(cmd.Process.Pid))
-		}
-		for _, pid := range d.pids {
-			pids = append(pids, strconv.Itoa(pid))
-		}
-		msg += "Running (" + strings.Join(pids, ", ") + ")"
-	case StateStarting:
-		msg += "Starting"
-	case StateStopped:
-		msg += "Stopped"
-	case StateStopping:
-		msg += "Stopping"
-	default:
-		msg += "Unknown"
-	}
-	if d.isMasked {
-		msg += " (masked)"
+	return append([]string{}, d.loadMessages...)
+}
+
+// loadError returns the reason a unit which did not load properly cannot be started; must be called with the lock held
+func (d *daemon) loadError() error {
+	switch d.loadState {
+	case LoadStateBadSetting:
+		return fmt.Errorf("unit %s.service has a bad unit file setting", d.name)
+	case LoadStateError:
+		return fmt.Errorf("unit %s.service failed to load properly", d.name)
+	case LoadStateNotFound:
+		return fmt.Errorf("unit %s.service not found", d.name)
 	}
-	return msg, d.stateError
+	return nil
+}
+
+// MainPID returns the PID of the main process, or 0 if not running or not known
+func (d *daemon) MainPID() int {
+	d.RLock()
+	defer d.RUnlock()
+	return d.mainPid()
+}
+
+// ControlPID returns the PID of the running control process, or 0
+func (d *daemon) ControlPID() int {
+	d.RLock()
+	defer d.RUnlock()
+	return d.controlPid()
 }
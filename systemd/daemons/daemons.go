@@ -2,6 +2,7 @@ package daemons
 
 import (
 	"docker-systemd/common"
+	"fmt"
 	"log"
 	"os"
 	"path"
@@ -9,6 +10,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 
 	"github.com/bestmethod/inslice"
 )
@@ -16,9 +18,31 @@ import (
 type daemons struct {
 	list     map[string]*daemon
 	shutdown atomic.Bool
+	env      managerEnv
+	order    startOrder
+	jobs     jobQueue
 	sync.RWMutex
 }
 
+// startOrder records the order in which units were started, so that they can be stopped in reverse
+type startOrder struct {
+	sync.Mutex
+	started []*daemon
+}
+
+// started moves the unit to the end of the start order
+func (ds *daemons) started(d *daemon) {
+	ds.order.Lock()
+	defer ds.order.Unlock()
+	for i, item := range ds.order.started {
+		if item == d {
+			ds.order.started = append(ds.order.started[:i], ds.order.started[i+1:]...)
+			break
+		}
+	}
+	ds.order.started = append(ds.order.started, d)
+}
+
 // IsShuttingDown returns true if the system is currently shutting down
 func (ds *daemons) IsShuttingDown() bool {
 	return ds.shutdown.Load()
@@ -40,44 +64,69 @@ func (ds *daemons) LoadAndStart() error {
 	if err != nil {
 		return err
 	}
-	target := "/etc/systemd/system/multi-user.target.wants"
-	dir, err := os.ReadDir(target)
-	if err != nil {
-		return nil
-	}
 	ds.RLock()
-	for _, entry := range dir {
-		if entry.IsDir() {
-			continue
-		}
-		if !strings.HasSuffix(entry.Name(), ".service") {
-			continue
+	names := []string{}
+	for _, target := range []string{bootWantsDir(localUnitPath), bootWantsDir(runtimeUnitPath)} {
+		dir, _ := os.ReadDir(target)
+		for _, entry := range dir {
+			if entry.IsDir() {
+				continue
+			}
+			name := strings.TrimSuffix(entry.Name(), ".service")
+			if !strings.HasSuffix(entry.Name(), ".service") || inslice.HasString(names, name) {
+				continue
+			}
+			names = append(names, name)
 		}
-		serviceName := strings.TrimSuffix(entry.Name(), ".service")
+	}
+	// units are started in After=/Before= order, each through the job queue
+	units := []*daemon{}
+	for _, serviceName := range ds.orderedStart(names) {
 		d, ok := ds.list[serviceName]
 		if !ok {
 			log.Printf("INIT: Wanted target service not found: %s", serviceName)
+			continue
 		}
-		log.Printf("INIT: Starting: %s", serviceName)
-		err = d.Start()
+		units = append(units, d)
+	}
+	ds.RUnlock()
+	for _, d := range units {
+		log.Printf("INIT: Starting: %s", d.name)
+		err = d.queueJob("start", "replace", true, nil)
 		if err != nil {
-			log.Printf("INIT: Failed to start %s: %s", serviceName, err)
+			log.Printf("INIT: Failed to start %s: %s", d.name, err)
 		} else {
-			log.Printf("INIT: Started: %s", serviceName)
+			log.Printf("INIT: Started: %s", d.name)
 		}
 	}
-	ds.RUnlock()
 	return nil
 }
 
 func (ds *daemons) StopAll() error {
 	ds.shutdown.Store(true) // Set shutdown flag FIRST to prevent new restarts
+	ds.order.Lock()
+	items := []*daemon{}
+	for i := len(ds.order.started) - 1; i >= 0; i-- {
+		items = append(items, ds.order.started[i])
+	}
+	ds.order.Unlock()
 	ds.RLock()
+	// units are stopped in reverse start order, followed by any others which are not stopped
+	ordered := make(map[*daemon]bool)
+	for _, item := range items {
+		ordered[item] = true
+	}
 	for _, item := range ds.list {
+		if !ordered[item] {
+			items = append(items, item)
+		}
+	}
+	ds.RUnlock()
+	for _, item := range items {
 		state := item.State()
 		if state != StateStopped && state != StateStopping {
 			log.Printf("SHUTDOWN: Stopping: %s", item.Name())
-			err := item.Stop()
+			err := item.queueJob("stop", "replace", false, nil)
 			if err != nil {
 				log.Printf("SHUTDOWN: Failed to stop %s: %s", item.Name(), err)
 			} else {
@@ -85,18 +134,35 @@ func (ds *daemons) StopAll() error {
 			}
 		}
 	}
-	ds.RUnlock()
 	return nil
 }
 
+// KillAll sends the signal to the processes of all units without stopping them in order, setting the shutdown flag first
+func (ds *daemons) KillAll(sig syscall.Signal) {
+	ds.shutdown.Store(true)
+	ds.RLock()
+	defer ds.RUnlock()
+	for _, item := range ds.list {
+		item.RLock()
+		pids := item.unitPids()
+		if pid := item.controlPid(); pid != 0 {
+			pids = append(pids, pid)
+		}
+		item.RUnlock()
+		for _, pid := range pids {
+			log.Printf("SHUTDOWN: Sending signal %s to %d (%s)", signalName(sig), pid, item.Name())
+			syscall.Kill(pid, sig)
+		}
+	}
+}
+
+// Reload loads the unit files into new definitions, which are then swapped in under the lock of each unit, so that
+// the units are never seen without a definition while loading
 func (ds *daemons) Reload() error {
+	ds.loadEnvironment()
 	ds.RWMutex.Lock()
-	for _, d := range ds.list {
-		d.olddef = d.def
-		d.def = nil
-	}
 	defer ds.RWMutex.Unlock()
-	failedloads := []string{}
+	loaded := make(map[string]*daemon)
 	processedFiles := []string{}
 	for _, locs := range common.GetSystemdPaths() {
 		if _, err := os.Stat(locs); err != nil {
@@ -117,26 +183,24 @@ func (ds *daemons) Reload() error {
 				continue
 			}
 			fn = strings.TrimSuffix(fn, ".service")
-			d := &daemon{
-				name:   fn,
-				paths:  []string{fpath},
-				state:  StateStopped,
-				parent: ds,
-			}
-			if _, ok := ds.list[fn]; ok {
-				d = ds.list[fn]
-				d.Lock()
-				d.parent = ds // Ensure parent is set for existing daemons
-				if !inslice.HasString(d.paths, fpath) {
-					d.paths = append(d.paths, fpath)
+			d, ok := loaded[fn]
+			if !ok {
+				d = &daemon{
+					name:   fn,
+					parent: ds,
 				}
-				d.Unlock()
+				loaded[fn] = d
+			}
+			if !inslice.HasString(d.paths, fpath) {
+				d.paths = append(d.paths, fpath)
+			}
+			if d.loadState != "" {
+				// a higher priority location already provided the unit file
+				continue
 			}
 			// handle masked services
-			isMasked := false
-			d.Lock()
-			d.isMasked = false
-			d.Unlock()
+			d.fragment = fpath
+			d.loadState = LoadStateLoaded
 			processedFile := fpath
 			if nstat, err := os.Lstat(fpath); err == nil && nstat.Mode()&os.ModeSymlink != 0 {
 				linkdest, err := os.Readlink(fpath)
@@ -144,122 +208,102 @@ func (ds *daemons) Reload() error {
 					processedFile = linkdest
 				}
 				if err == nil && linkdest == "/dev/null" {
-					d.Lock()
 					d.isMasked = true
-					isMasked = true
-					d.Unlock()
+					d.loadState = LoadStateMasked
+					d.def = newDaemonDef()
 				}
 			}
 			// end
-			if !isMasked && !inslice.HasString(processedFiles, processedFile) {
+			if !d.isMasked && !inslice.HasString(processedFiles, processedFile) {
 				processedFiles = append(processedFiles, processedFile)
 				f, err := os.Open(fpath)
 				if err != nil {
+					d.def = newDaemonDef()
+					d.loadState = LoadStateError
+					d.loadMessages = append(d.loadMessages, fmt.Sprintf("%s: %s", fpath, err))
 					log.Printf("Could not read %s: %s", fpath, err)
-					continue
-				}
-				defer f.Close()
-				err = loadUnitFile(d, f)
-				if err != nil {
-					d.Lock()
-					d.def = d.olddef
-					d.olddef = nil
-					failedloads = append(failedloads, d.name)
-					d.Unlock()
-					log.Printf("ERROR loading unit for %s: %s", fpath, err)
-					continue
+				} else {
+					err = loadUnitFile(d, f, fpath)
+					f.Close()
+					if err != nil {
+						d.loadState = LoadStateError
+						d.loadMessages = append(d.loadMessages, fmt.Sprintf("%s: %s", fpath, err))
+						log.Printf("ERROR loading unit for %s: %s", fpath, err)
+					}
 				}
 			}
-			ds.list[fn] = d
 		}
 	}
-	for _, locs := range common.GetSystemdPaths() {
-		if _, err := os.Stat(locs); err != nil {
+	for fn, d := range loaded {
+		if d.def == nil || d.loadState != LoadStateLoaded {
 			continue
 		}
-		entries, err := os.ReadDir(locs)
-		if err != nil {
-			log.Printf("Could not read %s: %s", locs, err)
-			continue
-		}
-		for _, entry := range entries {
-			if !entry.IsDir() {
-				continue
-			}
-			fn := entry.Name()
-			fpath := path.Join(locs, fn)
-			if !strings.HasSuffix(fpath, ".service.d") {
-				continue
-			}
-			fn = strings.TrimSuffix(fn, ".service.d")
-			if inslice.HasString(failedloads, fn) {
-				continue
-			}
-			if _, ok := ds.list[fn]; !ok {
-				continue
-			}
-			d := ds.list[fn]
-			// now load all files from the file subdir
-			entriesa, err := os.ReadDir(fpath)
+		for _, fpatha := range findDropIns(fn) {
+			d.dropins = append(d.dropins, fpatha)
+			f, err := os.Open(fpatha)
 			if err != nil {
-				log.Printf("Could not read %s: %s", fpath, err)
+				log.Printf("Could not read %s: %s", fpatha, err)
 				continue
 			}
-			for _, entrya := range entriesa {
-				if entrya.IsDir() {
-					continue
-				}
-				fna := entrya.Name()
-				if !strings.HasSuffix(fna, ".conf") {
-					continue
-				}
-				fpatha := path.Join(fpath, fna)
-				d.Lock()
-				if !inslice.HasString(d.paths, fpatha) {
-					d.paths = append(d.paths, fpatha)
-				}
-				d.Unlock()
-				processedFile := fpatha
-				if nstat, err := os.Lstat(fpatha); err == nil && nstat.Mode()&os.ModeSymlink != 0 {
-					linkdest, err := os.Readlink(fpatha)
-					if err == nil {
-						processedFile = linkdest
-					}
-				}
-				if !inslice.HasString(processedFiles, processedFile) {
-					processedFiles = append(processedFiles, processedFile)
-					f, err := os.Open(fpatha)
-					if err != nil {
-						log.Printf("Could not read %s: %s", fpatha, err)
-						continue
-					}
-					defer f.Close()
-					err = loadUnitFile(d, f)
-					if err != nil {
-						d.Lock()
-						d.def = d.olddef
-						d.olddef = nil
-						failedloads = append(failedloads, d.name)
-						d.Unlock()
-						log.Printf("ERROR loading unit for %s: %s", fpatha, err)
-						continue
-					}
-				}
+			err = loadUnitFile(d, f, fpatha)
+			f.Close()
+			if err != nil {
+				d.loadState = LoadStateError
+				d.loadMessages = append(d.loadMessages, fmt.Sprintf("%s: %s", fpatha, err))
+				log.Printf("ERROR loading unit for %s: %s", fpatha, err)
+				break
 			}
-			// end
-			ds.list[fn] = d
 		}
+		d.loadDependencyDirs()
+		d.verify()
 	}
 	for r, d := range ds.list {
+		if n, ok := loaded[r]; ok && n.def != nil {
+			continue
+		}
 		d.Lock()
-		d.olddef = nil
-		if d.def == nil && d.state == StateStopped {
+		if d.state == StateStopped {
 			delete(ds.list, r)
+		} else {
+			// unit file removed while the service is running, keep the old definition so that it can be stopped
+			d.fragment = ""
+			d.dropins = nil
+			d.loadState = LoadStateNotFound
+			d.loadMessages = nil
 		}
 		d.Unlock()
 	}
+	for r, n := range loaded {
+		if n.def == nil {
+			continue
+		}
+		d, ok := ds.list[r]
+		if !ok {
+			d = &daemon{
+				name:     r,
+				state:    StateStopped,
+				subState: SubStateDead,
+			}
+			ds.list[r] = d
+		}
+		d.Lock()
+		d.parent = ds // Ensure parent is set for existing daemons
+		for _, fpath := range n.paths {
+			if !inslice.HasString(d.paths, fpath) {
+				d.paths = append(d.paths, fpath)
+			}
+		}
+		d.def = n.def
+		d.fragment = n.fragment
+		d.dropins = n.dropins
+		d.isMasked = n.isMasked
+		d.loadState = n.loadState
+		d.loadMessages = n.loadMessages
+		d.Unlock()
+	}
 	for r, d := range ds.list {
 		d.Lock()
+		d.dropSelfDeps()
 		for depName := range d.def.Requires {
 			d.def.Requires[depName] = ds.list[depName]
 			if _, ok := ds.list[depName]; !ok {
@@ -297,7 +341,7 @@ func (ds *daemons) Reload() error {
 			ds.list[depName].Unlock()
 		}
 		for depName := range d.def.Requisite {
-			d.def.Requires[depName] = ds.list[depName]
+			d.def.Requisite[depName] = ds.list[depName]
 			if _, ok := ds.list[depName]; !ok {
 				continue
 			}
@@ -410,7 +454,7 @@ func (ds *daemons) Reload() error {
 				continue
 			}
 			ds.list[depName].Lock()
-			ds.list[depName].def.OnSuccess[r] = d
+			ds.list[depName].def.OnFailureOf[r] = d
 			ds.list[depName].Unlock()
 		}
 		for depName := range d.def.OnSuccess {
@@ -419,14 +463,120 @@ func (ds *daemons) Reload() error {
 				continue
 			}
 			ds.list[depName].Lock()
-			ds.list[depName].def.OnFailure[r] = d
+			ds.list[depName].def.OnSuccessOf[r] = d
+			ds.list[depName].Unlock()
+		}
+		for depName := range d.def.PropagatesReloadTo {
+			d.def.PropagatesReloadTo[depName] = ds.list[depName]
+			if _, ok := ds.list[depName]; !ok {
+				continue
+			}
+			ds.list[depName].Lock()
+			ds.list[depName].def.ReloadPropagatedFrom[r] = d
+			ds.list[depName].Unlock()
+		}
+		for depName := range d.def.ReloadPropagatedFrom {
+			d.def.ReloadPropagatedFrom[depName] = ds.list[depName]
+			if _, ok := ds.list[depName]; !ok {
+				continue
+			}
+			ds.list[depName].Lock()
+			ds.list[depName].def.PropagatesReloadTo[r] = d
+			ds.list[depName].Unlock()
+		}
+		for depName := range d.def.PropagatesStopTo {
+			d.def.PropagatesStopTo[depName] = ds.list[depName]
+			if _, ok := ds.list[depName]; !ok {
+				continue
+			}
+			ds.list[depName].Lock()
+			ds.list[depName].def.StopPropagatedFrom[r] = d
+			ds.list[depName].Unlock()
+		}
+		for depName := range d.def.StopPropagatedFrom {
+			d.def.StopPropagatedFrom[depName] = ds.list[depName]
+			if _, ok := ds.list[depName]; !ok {
+				continue
+			}
+			ds.list[depName].Lock()
+			ds.list[depName].def.PropagatesStopTo[r] = d
 			ds.list[depName].Unlock()
 		}
 		d.Unlock()
 	}
+	ds.validateDeps()
 	return nil
 }
 
+// dropInDirs returns the names of drop-in directories applying to a service, from the most generic to the most specific:
+// the top-level service.d, dash-truncated prefixes (foo-.service.d), the template (foo@.service.d) and the unit itself
+func dropInDirs(name string) []string {
+	dirs := []string{"service.d"}
+	prefix := strings.Split(name, "@")[0]
+	parts := strings.Split(prefix, "-")
+	for i := 1; i < len(parts); i++ {
+		dirs = append(dirs, strings.Join(parts[0:i], "-")+"-.service.d")
+	}
+	if strings.Contains(name, "@") && !strings.HasSuffix(name, "@") {
+		dirs = append(dirs, prefix+"@.service.d")
+	}
+	return append(dirs, name+".service.d")
+}
+
+// findDropIns returns the list of drop-in .conf files for a service, sorted by file name as systemd does;
+// a file in a higher priority location, or in a more specific directory, overrides a file with the same name
+func findDropIns(name string) []string {
+	files := make(map[string]string)
+	dirs := dropInDirs(name)
+	for _, locs := range common.GetSystemdPaths() {
+		for i := len(dirs) - 1; i >= 0; i-- {
+			fpath := path.Join(locs, dirs[i])
+			entries, err := os.ReadDir(fpath)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					log.Printf("Could not read %s: %s", fpath, err)
+				}
+				continue
+			}
+			for _, entry := range entries {
+				if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".conf") {
+					continue
+				}
+				if _, ok := files[entry.Name()]; ok {
+					continue
+				}
+				files[entry.Name()] = path.Join(fpath, entry.Name())
+			}
+		}
+	}
+	names := []string{}
+	for n := range files {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	ret := []string{}
+	for _, n := range names {
+		fpath := files[n]
+		// drop-ins linked to /dev/null are disabled
+		if linkdest, err := os.Readlink(fpath); err == nil && linkdest == "/dev/null" {
+			continue
+		}
+		ret = append(ret, fpath)
+	}
+	return ret
+}
+
+// Lookup returns the loaded unit, without reloading the unit files if it is not found
+func (ds *daemons) Lookup(name string) (Daemon, error) {
+	ds.RLock()
+	defer ds.RUnlock()
+	if d, ok := ds.list[name]; ok {
+		return d, nil
+	}
+	return nil, ErrNotFound
+}
+
+// Find returns the unit, reloading the unit files if it is not loaded yet
 func (ds *daemons) Find(name string) (Daemon, error) {
 	ds.RLock()
 	defer ds.RUnlock()
@@ -1,14 +1,26 @@
 package daemons
 
-import "errors"
+import (
+	"docker-systemd/common"
+	"errors"
+	"syscall"
+)
 
 // implements the Daemons interface for interacting with daemons
 type Daemons interface {
 	LoadAndStart() error
 	Reload() error
 	StopAll() error
+	KillAll(sig syscall.Signal)
 	Find(name string) (Daemon, error)
+	Lookup(name string) (Daemon, error)
 	List() []string
+	Environment() []string
+	SetEnvironment(assignments []string) error
+	UnsetEnvironment(names []string) error
+	Enqueue(name string, jobType string, mode string) (*Job, error)
+	Jobs() []JobInfo
+	CancelJob(id int) error
 }
 
 // implements the Daemon interface for interactive with a single daemon
@@ -21,17 +33,37 @@ type Daemon interface {
 	Disable() error
 	Mask() error
 	Unmask() error
-	Status() (string, error)
-	Detail() string
+	Status(opts StatusOptions) string
+	StatusInfo(lines int) UnitStatus
+	Properties() []Property
 	State() DaemonState
+	ActiveState() ActiveState
+	SubState() SubState
+	Result() Result
+	ResetFailed()
+	Description() string
+	LoadState() LoadState
+	LoadMessages() []string
+	MainPID() int
+	ControlPID() int
+	NeededBy() []string
+	Dependencies(direction string) []string
 	Reload() error
+	Kill(whom string, sig syscall.Signal) error
 	IsEnabled() bool
+	UnitFileState() UnitFileState
+	Cat() (string, error)
+	Revert() ([]string, error)
+	AddDependency(target string, requires bool) (string, error)
 	CreateInstance(name string) error
 	DeleteService() error
 }
 
 type DaemonState int
 
+// LoadState is the systemd LoadState= of a unit
+type LoadState string
+
 var ErrNotFound = errors.New("daemon not found")
 
 const (
@@ -42,8 +74,20 @@ const (
 	StateRestarting = DaemonState(5)
 )
 
+const (
+	LoadStateLoaded     = LoadState("loaded")
+	LoadStateNotFound   = LoadState("not-found")
+	LoadStateBadSetting = LoadState("bad-setting")
+	LoadStateError      = LoadState("error")
+	LoadStateMasked     = LoadState("masked")
+)
+
 func New() (Daemons, error) {
 	d := new(daemons)
 	d.list = make(map[string]*daemon)
+	isFirstBoot() // ConditionFirstBoot= is determined by the state at boot
+	if _, bootID, err := common.ReadBootFile(); err == nil {
+		setBootID(bootID)
+	}
 	return d, d.LoadAndStart()
 }
@@ -0,0 +1,274 @@
+package daemons
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/bestmethod/inslice"
+)
+
+// otherUnitTypes are the unit types which are not supported; dependencies on them are accepted and ignored
+var otherUnitTypes = []string{".target", ".socket", ".mount", ".automount", ".swap", ".path", ".timer", ".slice", ".scope", ".device"}
+
+// isOtherUnitType returns true if the dependency names a unit which is not a service
+func isOtherUnitType(name string) bool {
+	for _, suffix := range otherUnitTypes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// missingDep returns the error for a required dependency which does not exist, or nil if the dependency is not a
+// service and so cannot be checked
+func missingDep(name string) error {
+	if isOtherUnitType(name) {
+		return nil
+	}
+	return fmt.Errorf("Unit %s.service not found", name)
+}
+
+// depMaps returns the dependency settings of the unit definition
+func (def *daemondef) depMaps() map[string]map[string]*daemon {
+	return map[string]map[string]*daemon{
+		"Wants":                def.Wants,
+		"WantedBy":             def.WantedBy,
+		"Requires":             def.Requires,
+		"RequiredBy":           def.RequiredBy,
+		"Requisite":            def.Requisite,
+		"RequisiteOf":          def.RequisiteOf,
+		"BindsTo":              def.BindsTo,
+		"BoundBy":              def.BoundBy,
+		"PartOf":               def.PartOf,
+		"ConsistsOf":           def.ConsistsOf,
+		"Upholds":              def.Upholds,
+		"UpheldBy":             def.UpheldBy,
+		"Conflicts":            def.Conflicts,
+		"ConflictedBy":         def.ConflictedBy,
+		"Before":               def.Before,
+		"After":                def.After,
+		"OnFailure":            def.OnFailure,
+		"OnSuccess":            def.OnSuccess,
+		"OnFailureOf":          def.OnFailureOf,
+		"OnSuccessOf":          def.OnSuccessOf,
+		"PropagatesReloadTo":   def.PropagatesReloadTo,
+		"ReloadPropagatedFrom": def.ReloadPropagatedFrom,
+		"PropagatesStopTo":     def.PropagatesStopTo,
+		"StopPropagatedFrom":   def.StopPropagatedFrom,
+	}
+}
+
+// dropSelfDeps removes dependencies of the unit on itself, which systemd ignores; called with the daemon locked
+func (d *daemon) dropSelfDeps() {
+	settings := []string{}
+	for setting, deps := range d.def.depMaps() {
+		if _, ok := deps[d.name]; ok {
+			delete(deps, d.name)
+			settings = append(settings, setting)
+		}
+	}
+	sort.Strings(settings)
+	for _, setting := range settings {
+		log.Printf("<%s> Dependency %s=%s.service dropped, unit depends on itself", d.name, setting, d.name)
+	}
+}
+
+// validateDeps checks the dependency graph after a reload: required units which do not exist are reported and recorded
+// on the unit for status, and requirement and ordering cycles are broken; called with the list locked
+func (ds *daemons) validateDeps() {
+	names := []string{}
+	for name := range ds.list {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := ds.list[name]
+		d.Lock()
+		for _, setting := range []string{"Requires", "Requisite", "BindsTo"} {
+			deps := d.def.depMaps()[setting]
+			missing := []string{}
+			for depName, dep := range deps {
+				if dep == nil && missingDep(depName) != nil {
+					missing = append(missing, depName)
+				}
+			}
+			sort.Strings(missing)
+			for _, depName := range missing {
+				msg := fmt.Sprintf("%s=%s.service refers to a unit which does not exist", setting, depName)
+				log.Printf("<%s> WARNING: %s", name, msg)
+				d.loadMessages = append(d.loadMessages, d.fragment+": "+msg)
+			}
+		}
+		d.Unlock()
+	}
+	ds.breakRequirementCycles(names)
+	ds.breakOrderingCycles(names)
+}
+
+// breakCycles walks the graph in unit name order and calls drop for the edge closing each cycle found, with the units
+// of the cycle from the target of that edge back to it, so that the result is the same on every reload
+func breakCycles(names []string, graph map[string][]string, drop func(name string, depName string, cycle []string)) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	path := []string{}
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = visiting
+		path = append(path, name)
+		for _, depName := range graph[name] {
+			switch state[depName] {
+			case unvisited:
+				visit(depName)
+			case visiting:
+				cycle := []string{depName + ".service"}
+				for i := len(path) - 1; i >= 0 && path[i] != depName; i-- {
+					cycle = append([]string{path[i] + ".service"}, cycle...)
+				}
+				cycle = append([]string{depName + ".service"}, cycle...)
+				drop(name, depName, cycle)
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+	}
+	for _, name := range names {
+		if state[name] == unvisited {
+			visit(name)
+		}
+	}
+}
+
+// depGraph returns, for each unit, the sorted names of the existing units it refers to in the given settings; called
+// with the list locked
+func (ds *daemons) depGraph(names []string, settings ...string) map[string][]string {
+	graph := make(map[string][]string)
+	for _, name := range names {
+		d := ds.list[name]
+		d.RLock()
+		deps := d.def.depMaps()
+		for _, setting := range settings {
+			for depName, dep := range deps[setting] {
+				if dep != nil && !inslice.HasString(graph[name], depName) {
+					graph[name] = append(graph[name], depName)
+				}
+			}
+		}
+		d.RUnlock()
+		sort.Strings(graph[name])
+	}
+	return graph
+}
+
+// breakRequirementCycles removes the Requires= or BindsTo= dependency closing each requirement cycle, which would
+// otherwise have the start jobs of the units wait for each other; called with the list locked
+func (ds *daemons) breakRequirementCycles(names []string) {
+	breakCycles(names, ds.depGraph(names, "Requires", "BindsTo"), func(name string, depName string, cycle []string) {
+		log.Printf("WARNING: Found dependency cycle: %s", strings.Join(cycle, " requires "))
+		d, dep := ds.list[name], ds.list[depName]
+		d.Lock()
+		settings := []string{}
+		if _, ok := d.def.Requires[depName]; ok {
+			delete(d.def.Requires, depName)
+			settings = append(settings, "Requires")
+		}
+		if _, ok := d.def.BindsTo[depName]; ok {
+			delete(d.def.BindsTo, depName)
+			settings = append(settings, "BindsTo")
+		}
+		d.Unlock()
+		dep.Lock()
+		delete(dep.def.RequiredBy, name)
+		delete(dep.def.BoundBy, name)
+		dep.Unlock()
+		for _, setting := range settings {
+			log.Printf("WARNING: Breaking dependency cycle by dropping %s=%s.service from %s.service", setting, depName, name)
+		}
+	})
+}
+
+// breakOrderingCycles removes the After= ordering dependency closing each ordering cycle; called with the list locked
+func (ds *daemons) breakOrderingCycles(names []string) {
+	breakCycles(names, ds.depGraph(names, "After"), func(name string, depName string, cycle []string) {
+		log.Printf("WARNING: Found ordering cycle: %s", strings.Join(cycle, " after "))
+		log.Printf("WARNING: Breaking ordering cycle by dropping After=%s.service from %s.service", depName, name)
+		d, dep := ds.list[name], ds.list[depName]
+		d.Lock()
+		delete(d.def.After, depName)
+		d.Unlock()
+		dep.Lock()
+		delete(dep.def.Before, name)
+		dep.Unlock()
+	})
+}
+
+// orderedStart sorts the units so that each one comes after the units it is ordered After=; called with the list locked
+func (ds *daemons) orderedStart(names []string) []string {
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+	ordered := []string{}
+	seen := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		if d, ok := ds.list[name]; ok {
+			d.RLock()
+			deps := []string{}
+			for depName, dep := range d.def.After {
+				if dep != nil {
+					deps = append(deps, depName)
+				}
+			}
+			d.RUnlock()
+			sort.Strings(deps)
+			for _, depName := range deps {
+				visit(depName)
+			}
+		}
+		if wanted[name] {
+			ordered = append(ordered, name)
+		}
+	}
+	for _, name := range names {
+		visit(name)
+	}
+	return ordered
+}
+
+// Dependencies returns the sorted names of the units related to this one in the direction given: "requires" for the
+// units it pulls in, "reverse" for the units pulling it in, "before" or "after" for the ordering
+func (d *daemon) Dependencies(direction string) []string {
+	d.RLock()
+	defer d.RUnlock()
+	deps := d.def.depMaps()
+	settings := []string{"Requires", "Requisite", "Wants", "BindsTo", "Upholds"}
+	switch direction {
+	case "reverse":
+		settings = []string{"RequiredBy", "RequisiteOf", "WantedBy", "BoundBy", "UpheldBy"}
+	case "before":
+		settings = []string{"Before"}
+	case "after":
+		settings = []string{"After"}
+	}
+	names := []string{}
+	for _, setting := range settings {
+		for _, name := range strings.Fields(formatDeps(deps[setting])) {
+			if !inslice.HasString(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,73 @@
+package daemons
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestBreakCycles(t *testing.T) {
+	graph := map[string][]string{
+		"a": {"b"},
+		"b": {"c"},
+		"c": {"a", "d"},
+		"d": {},
+		"e": {"f"},
+		"f": {"e"},
+	}
+	type edge struct{ name, dep string }
+	dropped := []edge{}
+	cycles := [][]string{}
+	breakCycles([]string{"a", "b", "c", "d", "e", "f"}, graph, func(name string, depName string, cycle []string) {
+		dropped = append(dropped, edge{name, depName})
+		cycles = append(cycles, cycle)
+	})
+	want := []edge{{"c", "a"}, {"f", "e"}}
+	if !slices.Equal(dropped, want) {
+		t.Fatalf("breakCycles dropped %v, want %v", dropped, want)
+	}
+	if want := []string{"a.service", "b.service", "c.service", "a.service"}; !slices.Equal(cycles[0], want) {
+		t.Errorf("breakCycles reported cycle %q, want %q", cycles[0], want)
+	}
+}
+
+func TestBreakRequirementCycles(t *testing.T) {
+	ds := &daemons{list: make(map[string]*daemon)}
+	a, b, c := newTestUnit(ds, "a"), newTestUnit(ds, "b"), newTestUnit(ds, "c")
+	a.def.Requires["b"], b.def.RequiredBy["a"] = b, a
+	b.def.BindsTo["c"], c.def.BoundBy["b"] = c, b
+	c.def.Requires["a"], a.def.RequiredBy["c"] = a, c
+	c.def.After["a"], a.def.Before["c"] = a, c
+	ds.validateDeps()
+	if _, ok := c.def.Requires["a"]; ok {
+		t.Errorf("Requires=a.service of c was kept, want the dependency closing the cycle dropped")
+	}
+	if _, ok := a.def.RequiredBy["c"]; ok {
+		t.Errorf("RequiredBy=c.service of a was kept, want the reverse dependency dropped too")
+	}
+	if _, ok := a.def.Requires["b"]; !ok {
+		t.Errorf("Requires=b.service of a was dropped, want only one dependency of the cycle dropped")
+	}
+	if _, ok := b.def.BindsTo["c"]; !ok {
+		t.Errorf("BindsTo=c.service of b was dropped, want only one dependency of the cycle dropped")
+	}
+	if _, ok := c.def.After["a"]; !ok {
+		t.Errorf("After=a.service of c was dropped, but it is not part of an ordering cycle")
+	}
+}
+
+func TestValidateDepsRecordsMissingUnits(t *testing.T) {
+	ds := &daemons{list: make(map[string]*daemon)}
+	a := newTestUnit(ds, "a")
+	a.fragment = "/etc/systemd/system/a.service"
+	a.def.Requires["missing"] = nil
+	a.def.Wants["optional"] = nil
+	a.def.Requires["network.target"] = nil
+	ds.validateDeps()
+	want := []string{"/etc/systemd/system/a.service: Requires=missing.service refers to a unit which does not exist"}
+	if got := a.LoadMessages(); !slices.Equal(got, want) {
+		t.Errorf("LoadMessages() = %q, want %q", got, want)
+	}
+	if got := a.LoadState(); got != LoadStateLoaded {
+		t.Errorf("LoadState() = %s, want %s", got, LoadStateLoaded)
+	}
+}
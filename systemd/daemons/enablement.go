@@ -0,0 +1,155 @@
+package daemons
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// UnitFileState is the systemd UnitFileState= of a unit, as shown by is-enabled and list-unit-files
+type UnitFileState string
+
+const (
+	UnitFileEnabled        = UnitFileState("enabled")
+	UnitFileEnabledRuntime = UnitFileState("enabled-runtime")
+	UnitFileDisabled       = UnitFileState("disabled")
+	UnitFileStatic         = UnitFileState("static")
+	UnitFileMasked         = UnitFileState("masked")
+	UnitFileIndirect       = UnitFileState("indirect")
+	UnitFileGenerated      = UnitFileState("generated")
+	UnitFileAlias          = UnitFileState("alias")
+)
+
+// runtimeUnitPath holds the enablement links which do not survive a reboot
+var runtimeUnitPath = "/run/systemd/system"
+
+// bootTarget is the target whose .wants/ directories in /etc and /run hold the units started at boot
+const bootTarget = "multi-user.target"
+
+// bootWantsDir returns the .wants/ directory of the boot target below the unit path
+func bootWantsDir(dir string) string {
+	return path.Join(dir, bootTarget+".wants")
+}
+
+// generatorPaths hold the unit files written by generators
+var generatorPaths = []string{"/run/systemd/generator.early", "/run/systemd/generator", "/run/systemd/generator.late"}
+
+// presetPaths hold the *.preset files, in order of priority
+var presetPaths = []string{"/etc/systemd/system-preset", "/run/systemd/system-preset", "/usr/local/lib/systemd/system-preset",
+	"/usr/lib/systemd/system-preset", "/lib/systemd/system-preset"}
+
+// IsEnabled returns true if the unit is started at boot, persistently or at runtime
+func (d *daemon) IsEnabled() bool {
+	state := d.UnitFileState()
+	return state == UnitFileEnabled || state == UnitFileEnabledRuntime
+}
+
+// UnitFileState returns the enablement state of the unit file
+func (d *daemon) UnitFileState() UnitFileState {
+	d.RLock()
+	defer d.RUnlock()
+	switch {
+	case d.isMasked:
+		return UnitFileMasked
+	case isGenerated(d.fragment):
+		return UnitFileGenerated
+	case isAlias(d.fragment, d.name):
+		return UnitFileAlias
+	}
+	if isLinked(bootWantsDir(localUnitPath), d.name) {
+		return UnitFileEnabled
+	}
+	if isLinked(bootWantsDir(runtimeUnitPath), d.name) {
+		return UnitFileEnabledRuntime
+	}
+	if d.def == nil || !d.def.Installable {
+		if d.def != nil && len(d.def.Also) > 0 {
+			return UnitFileIndirect
+		}
+		return UnitFileStatic
+	}
+	if strings.HasSuffix(d.name, "@") && d.def.DefaultInstance == "" {
+		// a template without DefaultInstance= can only be enabled for an explicit instance
+		return UnitFileIndirect
+	}
+	return UnitFileDisabled
+}
+
+// isLinked returns true if the .wants/ directory holds the unit
+func isLinked(dir string, name string) bool {
+	_, err := os.Lstat(path.Join(dir, name+".service"))
+	return err == nil
+}
+
+// isGenerated returns true if the unit file was written by a generator
+func isGenerated(fragment string) bool {
+	for _, p := range generatorPaths {
+		if strings.HasPrefix(fragment, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isAlias returns true if the unit file is a symlink to a unit file of another name
+func isAlias(fragment string, name string) bool {
+	if fragment == "" {
+		return false
+	}
+	fi, err := os.Lstat(fragment)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	dest, err := os.Readlink(fragment)
+	if err != nil || dest == "/dev/null" {
+		return false
+	}
+	return path.Base(dest) != name+".service"
+}
+
+// VendorPreset returns the preset policy for the unit, enabled or disabled, from the first *.preset rule matching it;
+// units without a matching rule are enabled, same as in systemd
+func VendorPreset(unit string) string {
+	files := map[string]string{}
+	names := []string{}
+	for _, dir := range presetPaths {
+		matches, _ := filepath.Glob(path.Join(dir, "*.preset"))
+		for _, m := range matches {
+			// a file in a higher priority directory replaces one of the same name
+			if _, ok := files[path.Base(m)]; !ok {
+				files[path.Base(m)] = m
+				names = append(names, path.Base(m))
+			}
+		}
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		f, err := os.Open(files[n])
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+				continue
+			}
+			if ok, _ := path.Match(fields[1], unit); !ok {
+				continue
+			}
+			switch fields[0] {
+			case "enable":
+				f.Close()
+				return "enabled"
+			case "disable":
+				f.Close()
+				return "disabled"
+			}
+		}
+		f.Close()
+	}
+	return "enabled"
+}
@@ -0,0 +1,499 @@
+package daemons
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// managerEnv is the manager environment block which is passed to all started services
+type managerEnv struct {
+	sync.RWMutex
+	boot    []string // container environment at boot
+	env     []string // effective environment
+	runtime []envOp  // set-environment and unset-environment operations, replayed on every reload
+}
+
+type envOp struct {
+	unset bool
+	value string
+}
+
+// loadEnvironment rebuilds the manager environment from the container environment, /etc/environment,
+// environment.d, DefaultEnvironment= in system.conf and finally the runtime set/unset operations
+func (ds *daemons) loadEnvironment() {
+	ds.env.Lock()
+	defer ds.env.Unlock()
+	if ds.env.boot == nil {
+		ds.env.boot = os.Environ()
+	}
+	env := append([]string{}, ds.env.boot...)
+	files := []string{"/etc/environment"}
+	files = append(files, confFiles([]string{"/usr/lib/environment.d", "/usr/local/lib/environment.d", "/run/environment.d", "/etc/environment.d"})...)
+	for _, fn := range files {
+		ct, err := os.ReadFile(fn)
+		if err != nil {
+			continue
+		}
+		assignments, invalid := parseEnvFile(string(ct), env)
+		for _, line := range invalid {
+			log.Printf("ENVIRONMENT: %s: Invalid environment assignment, ignoring: %s", fn, line)
+		}
+		for _, kv := range assignments {
+			env = envSet(env, kv)
+		}
+	}
+	files = []string{"/etc/systemd/system.conf"}
+	files = append(files, confFiles([]string{"/usr/lib/systemd/system.conf.d", "/usr/local/lib/systemd/system.conf.d", "/run/systemd/system.conf.d", "/etc/systemd/system.conf.d"})...)
+	for _, fn := range files {
+		for _, kv := range readDefaultEnvironment(fn) {
+			env = envSet(env, kv)
+		}
+	}
+	for _, op := range ds.env.runtime {
+		if op.unset {
+			env = envUnset(env, op.value)
+		} else {
+			env = envSet(env, op.value)
+		}
+	}
+	ds.env.env = env
+}
+
+// Environment returns the manager environment, sorted by variable name
+func (ds *daemons) Environment() []string {
+	ds.env.RLock()
+	defer ds.env.RUnlock()
+	env := append([]string{}, ds.env.env...)
+	sort.Strings(env)
+	return env
+}
+
+// SetEnvironment sets manager environment variables for subsequently started units; kept across daemon-reload
+func (ds *daemons) SetEnvironment(assignments []string) error {
+	for _, kv := range assignments {
+		if !isValidEnvAssignment(kv) {
+			return fmt.Errorf("not a valid environment variable assignment: %s", kv)
+		}
+	}
+	ds.env.Lock()
+	defer ds.env.Unlock()
+	for _, kv := range assignments {
+		ds.env.runtime = append(ds.env.runtime, envOp{value: kv})
+		ds.env.env = envSet(ds.env.env, kv)
+	}
+	return nil
+}
+
+// UnsetEnvironment removes manager environment variables, by name or exact KEY=VALUE assignment; kept across daemon-reload
+func (ds *daemons) UnsetEnvironment(names []string) error {
+	for _, name := range names {
+		if !isValidEnvAssignment(name) && !isValidEnvAssignment(name+"=") {
+			return fmt.Errorf("not a valid environment variable name or assignment: %s", name)
+		}
+	}
+	ds.env.Lock()
+	defer ds.env.Unlock()
+	for _, name := range names {
+		ds.env.runtime = append(ds.env.runtime, envOp{unset: true, value: name})
+		ds.env.env = envUnset(ds.env.env, name)
+	}
+	return nil
+}
+
+// confFiles returns the *.conf files from the given directories, sorted by file name; a file in a later directory
+// overrides a file with the same name in an earlier one
+func confFiles(dirs []string) []string {
+	files := make(map[string]string)
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".conf") {
+				continue
+			}
+			files[entry.Name()] = path.Join(dir, entry.Name())
+		}
+	}
+	names := []string{}
+	for n := range files {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	ret := []string{}
+	for _, n := range names {
+		ret = append(ret, files[n])
+	}
+	return ret
+}
+
+// readDefaultEnvironment returns the DefaultEnvironment= assignments from the [Manager] section of a system.conf file
+func readDefaultEnvironment(fn string) []string {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	env := []string{}
+	section := ""
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line[1 : len(line)-1]
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok || section != "Manager" || strings.TrimSpace(k) != "DefaultEnvironment" {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		if v == "" {
+			env = []string{}
+			continue
+		}
+		words, err := splitQuoted(v)
+		if err != nil {
+			log.Printf("ENVIRONMENT: %s: Invalid DefaultEnvironment=, ignoring: %s", fn, v)
+			continue
+		}
+		for _, w := range words {
+			if isValidEnvAssignment(w) {
+				env = append(env, w)
+			} else {
+				log.Printf("ENVIRONMENT: %s: Invalid environment assignment, ignoring: %s", fn, w)
+			}
+		}
+	}
+	return env
+}
+
+// managerEnvironment returns the environment block of the service manager
+func (d *daemon) managerEnvironment() []string {
+	if d.parent == nil {
+		return os.Environ()
+	}
+	return d.parent.Environment()
+}
+
+// environment builds the service environment in systemd's order of precedence: the manager environment,
+// PassEnvironment=, Environment=, EnvironmentFile= and finally UnsetEnvironment=; must be called with the lock held
+func (d *daemon) environment() ([]string, error) {
+	menv := d.managerEnvironment()
+	env := append([]string{}, menv...)
+	for _, name := range d.def.PassEnv {
+		if v, ok := envGet(menv, name); ok {
+			env = envSet(env, name+"="+v)
+		}
+	}
+	for _, kv := range d.def.Env {
+		env = envSet(env, kv)
+	}
+	for _, ef := range d.def.EnvFile {
+		optional := strings.HasPrefix(ef, "-")
+		ef = strings.TrimPrefix(ef, "-")
+		files, err := filepath.Glob(ef)
+		if err != nil {
+			return nil, fmt.Errorf("env file %s: %s", ef, err)
+		}
+		if len(files) == 0 {
+			if optional {
+				continue
+			}
+			return nil, fmt.Errorf("env file %s not found", ef)
+		}
+		for _, fn := range files {
+			ct, err := os.ReadFile(fn)
+			if err != nil {
+				if optional {
+					continue
+				}
+				return nil, fmt.Errorf("env file %s not readable: %s", fn, err)
+			}
+			assignments, invalid := parseEnvFile(string(ct), env)
+			for _, line := range invalid {
+				log.Printf("<%s> %s: Invalid environment assignment, ignoring: %s", d.name, fn, line)
+			}
+			for _, kv := range assignments {
+				env = envSet(env, kv)
+			}
+		}
+	}
+	for _, u := range d.def.UnsetEnv {
+		env = envUnset(env, u)
+	}
+	return env, nil
+}
+
+// execEnv returns the environment for a process of the current activation, with the variables systemd sets
+// for all service processes followed by extra; called with the daemon locked
+func (d *daemon) execEnv(extra ...string) []string {
+	env := d.env
+	if env == nil {
+		var err error
+		if env, err = d.environment(); err != nil {
+			env = d.managerEnvironment()
+		}
+	}
+	env = append([]string{}, env...)
+	if d.invocationID != "" {
+		env = envSet(env, "INVOCATION_ID="+d.invocationID)
+	}
+	env = envSet(env, "MANAGERPID="+strconv.Itoa(os.Getpid()))
+	for _, kv := range extra {
+		env = envSet(env, kv)
+	}
+	return env
+}
+
+// mainPidEnv returns MAINPID= if the main process is known; called with the daemon locked
+func (d *daemon) mainPidEnv() []string {
+	if pid := d.mainPid(); pid > 0 {
+		return []string{"MAINPID=" + strconv.Itoa(pid)}
+	}
+	return nil
+}
+
+// serviceResult returns the SERVICE_RESULT= value of the last activation; called with the daemon locked
+func (d *daemon) serviceResult() string {
+	switch {
+	case d.result != "" && d.result != ResultSuccess:
+		return string(d.result)
+	case d.stopTimedOut:
+		return string(ResultTimeout)
+	case d.exitStatus == nil && d.stateError != nil:
+		return string(ResultResources)
+	}
+	return string(waitResult(d.exitStatus))
+}
+
+// exitEnv returns SERVICE_RESULT=, EXIT_CODE= and EXIT_STATUS= with the given prefix (e.g. MONITOR_);
+// the latter two only if the main process has exited; called with the daemon locked
+func (d *daemon) exitEnv(prefix string) []string {
+	env := []string{prefix + "SERVICE_RESULT=" + d.serviceResult()}
+	ws := d.exitStatus
+	switch {
+	case ws == nil:
+	case ws.CoreDump():
+		env = append(env, prefix+"EXIT_CODE=dumped", prefix+"EXIT_STATUS="+signalName(ws.Signal()))
+	case ws.Signaled():
+		env = append(env, prefix+"EXIT_CODE=killed", prefix+"EXIT_STATUS="+signalName(ws.Signal()))
+	default:
+		env = append(env, prefix+"EXIT_CODE=exited", prefix+"EXIT_STATUS="+strconv.Itoa(ws.ExitStatus()))
+	}
+	return env
+}
+
+// isCleanSignal reports whether termination by the signal counts as a clean exit, same as in systemd
+func isCleanSignal(sig syscall.Signal) bool {
+	return sig == syscall.SIGHUP || sig == syscall.SIGINT || sig == syscall.SIGTERM || sig == syscall.SIGPIPE
+}
+
+// envSet adds a KEY=VALUE assignment, replacing any existing assignment of the same variable
+func envSet(env []string, kv string) []string {
+	k, _, _ := strings.Cut(kv, "=")
+	env = envUnset(env, k)
+	return append(env, kv)
+}
+
+// envUnset removes all assignments of a variable if given a name, or only the exact assignment if given KEY=VALUE
+func envUnset(env []string, u string) []string {
+	ret := []string{}
+	for _, e := range env {
+		if strings.Contains(u, "=") {
+			if e == u {
+				continue
+			}
+		} else if strings.HasPrefix(e, u+"=") {
+			continue
+		}
+		ret = append(ret, e)
+	}
+	return ret
+}
+
+// envGet returns the value of a variable from an environment block
+func envGet(env []string, k string) (string, bool) {
+	for i := len(env) - 1; i >= 0; i-- {
+		if v, ok := strings.CutPrefix(env[i], k+"="); ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// parseEnvFile parses an environment file following systemd's grammar: comments, blank lines, an optional 'export',
+// single and double quotes, backslash escapes and line continuations; ${VAR} and $VAR references are expanded using
+// assignments made earlier in the file, falling back to the given environment; returns valid assignments and invalid lines
+func parseEnvFile(content string, base []string) (assignments []string, invalid []string) {
+	const (
+		stateKey = iota
+		stateComment
+		stateValue
+		stateSingle
+		stateDouble
+	)
+	lookup := func(name string) string {
+		if v, ok := envGet(assignments, name); ok {
+			return v
+		}
+		v, _ := envGet(base, name)
+		return v
+	}
+	state := stateKey
+	key := strings.Builder{}
+	val := strings.Builder{}
+	pendingSpace := ""
+	valueStarted := false
+	finish := func() {
+		k := strings.TrimSpace(key.String())
+		if rest, ok := strings.CutPrefix(k, "export"); ok && rest != "" && (rest[0] == ' ' || rest[0] == '\t') {
+			k = strings.TrimSpace(rest)
+		}
+		kv := k + "=" + val.String()
+		if isValidEnvAssignment(kv) {
+			assignments = envSet(assignments, kv)
+		} else {
+			invalid = append(invalid, kv)
+		}
+		key.Reset()
+		val.Reset()
+		pendingSpace = ""
+		valueStarted = false
+		state = stateKey
+	}
+	// expand reads a variable reference starting after the '$', returning the number of bytes consumed
+	expand := func(s string) int {
+		if strings.HasPrefix(s, "{") {
+			end := strings.Index(s, "}")
+			if end < 0 {
+				val.WriteByte('$')
+				return 0
+			}
+			val.WriteString(lookup(s[1:end]))
+			return end + 1
+		}
+		n := 0
+		for n < len(s) && (s[n] == '_' || (s[n] >= 'a' && s[n] <= 'z') || (s[n] >= 'A' && s[n] <= 'Z') || (n > 0 && s[n] >= '0' && s[n] <= '9')) {
+			n++
+		}
+		if n == 0 {
+			val.WriteByte('$')
+			return 0
+		}
+		val.WriteString(lookup(s[:n]))
+		return n
+	}
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch state {
+		case stateKey:
+			switch {
+			case c == '\n':
+				if k := strings.TrimSpace(key.String()); k != "" {
+					invalid = append(invalid, k)
+				}
+				key.Reset()
+			case (c == '#' || c == ';') && strings.TrimSpace(key.String()) == "":
+				state = stateComment
+			case c == '=':
+				state = stateValue
+			default:
+				key.WriteByte(c)
+			}
+		case stateComment:
+			if c == '\n' {
+				key.Reset()
+				state = stateKey
+			}
+		case stateValue:
+			switch {
+			case c == '\n':
+				finish()
+			case c == ' ' || c == '\t' || c == '\r':
+				if valueStarted {
+					pendingSpace += string(c)
+				}
+			case c == '\\':
+				if i+1 < len(content) && content[i+1] == '\n' {
+					i++
+					continue
+				}
+				if i+1 < len(content) {
+					i++
+					val.WriteString(pendingSpace)
+					val.WriteByte(content[i])
+				}
+				pendingSpace = ""
+				valueStarted = true
+			case c == '\'':
+				val.WriteString(pendingSpace)
+				pendingSpace = ""
+				valueStarted = true
+				state = stateSingle
+			case c == '"':
+				val.WriteString(pendingSpace)
+				pendingSpace = ""
+				valueStarted = true
+				state = stateDouble
+			case c == '$':
+				val.WriteString(pendingSpace)
+				pendingSpace = ""
+				valueStarted = true
+				i += expand(content[i+1:])
+			default:
+				val.WriteString(pendingSpace)
+				pendingSpace = ""
+				valueStarted = true
+				val.WriteByte(c)
+			}
+		case stateSingle:
+			if c == '\'' {
+				state = stateValue
+			} else {
+				val.WriteByte(c)
+			}
+		case stateDouble:
+			switch c {
+			case '"':
+				state = stateValue
+			case '\\':
+				if i+1 >= len(content) {
+					continue
+				}
+				switch content[i+1] {
+				case '\n':
+				case '"', '\\', '`', '$':
+					val.WriteByte(content[i+1])
+				default:
+					val.WriteByte(c)
+					val.WriteByte(content[i+1])
+				}
+				i++
+			case '$':
+				i += expand(content[i+1:])
+			default:
+				val.WriteByte(c)
+			}
+		}
+	}
+	switch state {
+	case stateKey:
+		if k := strings.TrimSpace(key.String()); k != "" {
+			invalid = append(invalid, k)
+		}
+	case stateValue, stateSingle, stateDouble:
+		finish()
+	}
+	return assignments, invalid
+}
@@ -0,0 +1,46 @@
+package daemons
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		base        []string
+		want        []string
+		wantInvalid []string
+	}{
+		{name: "empty", content: ""},
+		{name: "plain", content: "A=1\nB=two words\n", want: []string{"A=1", "B=two words"}},
+		{name: "no trailing newline", content: "A=1", want: []string{"A=1"}},
+		{name: "comments and blank lines", content: "# comment\n; other\n\nA=1\n", want: []string{"A=1"}},
+		{name: "export", content: "export A=1\n", want: []string{"A=1"}},
+		{name: "whitespace around value", content: "A=  x y  \n", want: []string{"A=x y"}},
+		{name: "single quotes", content: `A='$B \n "c"'` + "\n", want: []string{`A=$B \n "c"`}},
+		{name: "double quotes", content: `A=" x \"y\" \$z "` + "\n", want: []string{`A= x "y" $z `}},
+		{name: "multi-line quotes", content: "A=\"one\ntwo\"\n", want: []string{"A=one\ntwo"}},
+		{name: "backslash escape", content: `A=a\ b\$c` + "\n", want: []string{"A=a b$c"}},
+		{name: "line continuation", content: "A=one\\\ntwo\n", want: []string{"A=onetwo"}},
+		{name: "later assignment wins", content: "A=1\nA=2\n", want: []string{"A=2"}},
+		{name: "expansion of earlier assignment", content: "A=x\nB=${A}y\nC=$A-z\n", want: []string{"A=x", "B=xy", "C=x-z"}},
+		{name: "expansion from base", content: "P=$HOME/bin\n", base: []string{"HOME=/root"}, want: []string{"P=/root/bin"}},
+		{name: "expansion of unset variable", content: "A=[$NOPE]\n", want: []string{"A=[]"}},
+		{name: "lone dollar", content: "A=$ 1\n", want: []string{"A=$ 1"}},
+		{name: "missing equals", content: "JUNK\nA=1\n", want: []string{"A=1"}, wantInvalid: []string{"JUNK"}},
+		{name: "invalid name", content: "1A=x\nA-B=y\n", wantInvalid: []string{"1A=x", "A-B=y"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, invalid := parseEnvFile(tt.content, tt.base)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseEnvFile(%q) assignments = %q, want %q", tt.content, got, tt.want)
+			}
+			if !slices.Equal(invalid, tt.wantInvalid) {
+				t.Errorf("parseEnvFile(%q) invalid = %q, want %q", tt.content, invalid, tt.wantInvalid)
+			}
+		})
+	}
+}
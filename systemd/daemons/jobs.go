@@ -0,0 +1,419 @@
+package daemons
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/bestmethod/inslice"
+)
+
+// JobTypes are the accepted job types
+var JobTypes = []string{"start", "stop", "restart", "reload", "verify-active"}
+
+// JobModes are the accepted job modes; replace-irreversibly and flush behave as replace
+var JobModes = []string{"replace", "fail", "isolate", "ignore-dependencies", "ignore-requirements", "replace-irreversibly", "flush"}
+
+// Job is a start, stop, restart, reload or verify-active request for a unit; jobs for the same unit run one after the
+// other, jobs for different units run in parallel
+type Job struct {
+	id       int
+	d        *daemon
+	jobType  string
+	mode     string
+	manual   bool
+	state    string // waiting or running
+	canceled bool
+	cancel   chan struct{} // closed when the job is canceled, so that the running operation stops at its next phase
+	err      error
+	done     chan struct{}
+	waitsFor *Job // the dependency job the running job is waiting for
+}
+
+// JobInfo is a snapshot of a queued job, as shown by list-jobs
+type JobInfo struct {
+	ID    int
+	Unit  string
+	Type  string
+	State string
+}
+
+// jobQueue holds at most one running and one waiting job per unit
+type jobQueue struct {
+	sync.Mutex
+	lastID int
+	units  map[*daemon]*unitJobs
+}
+
+type unitJobs struct {
+	running *Job
+	waiting *Job
+}
+
+// ID returns the job ID
+func (j *Job) ID() int {
+	return j.id
+}
+
+// Wait blocks until the job finished or was canceled, returning its error
+func (j *Job) Wait() error {
+	<-j.done
+	return j.err
+}
+
+// finish completes the job for all waiters; called with the queue locked
+func (j *Job) finish(err error) {
+	select {
+	case <-j.done:
+		return
+	default:
+	}
+	j.err = err
+	close(j.done)
+}
+
+// abort cancels the running job: waiters are told once the operation has unwound, and the control processes of the
+// unit are terminated so that it does not wait for them; called with the queue locked
+func (j *Job) abort() {
+	if j.canceled {
+		return
+	}
+	j.canceled = true
+	close(j.cancel)
+	go j.d.abortControl()
+}
+
+// mergeJobs returns the job type which covers both job types, or an empty string if the two conflict; a start merged
+// with a reload becomes reload-or-start, which reloads the unit if it is active and starts it otherwise
+func mergeJobs(a string, b string) string {
+	if a == b {
+		return a
+	}
+	if a == "stop" || b == "stop" {
+		return ""
+	}
+	types := []string{a, b}
+	switch {
+	case inslice.HasString(types, "restart"):
+		return "restart"
+	case inslice.HasString(types, "reload-or-start"), inslice.HasString(types, "start") && inslice.HasString(types, "reload"):
+		return "reload-or-start"
+	case inslice.HasString(types, "start"):
+		return "start"
+	}
+	return "reload" // reload and verify-active
+}
+
+// Enqueue adds a job for the unit, merging it with a queued job of the unit where possible; with the fail mode,
+// a conflicting queued job causes an error, otherwise the conflicting job is canceled
+func (ds *daemons) Enqueue(name string, jobType string, mode string) (*Job, error) {
+	dd, err := ds.Find(name)
+	if err != nil {
+		return nil, err
+	}
+	return ds.enqueue(dd.(*daemon), jobType, mode, true)
+}
+
+func (ds *daemons) enqueue(d *daemon, jobType string, mode string, manual bool) (*Job, error) {
+	if mode == "" {
+		mode = "replace"
+	}
+	if !inslice.HasString(JobTypes, jobType) {
+		return nil, fmt.Errorf("unknown job type %s", jobType)
+	}
+	if !inslice.HasString(JobModes, mode) {
+		return nil, fmt.Errorf("unknown job mode %s", mode)
+	}
+	ds.jobs.Lock()
+	defer ds.jobs.Unlock()
+	if ds.jobs.units == nil {
+		ds.jobs.units = make(map[*daemon]*unitJobs)
+	}
+	u, ok := ds.jobs.units[d]
+	if !ok {
+		u = &unitJobs{}
+		ds.jobs.units[d] = u
+	}
+	if w := u.waiting; w != nil {
+		if merged := mergeJobs(w.jobType, jobType); merged != "" {
+			w.jobType = merged
+			w.manual = w.manual || manual
+			return w, nil
+		}
+		if mode == "fail" {
+			return nil, fmt.Errorf("transaction for %s.service/%s is destructive (%s.service has '%s' job queued, but '%s' is included in transaction)", d.name, jobType, d.name, w.jobType, jobType)
+		}
+		log.Printf("JOB: %d %s.service/%s canceled, replaced by %s", w.id, d.name, w.jobType, jobType)
+		w.finish(errors.New("job canceled"))
+		u.waiting = nil
+	}
+	if r := u.running; r != nil && !r.canceled {
+		if r.jobType == jobType || (jobType == "verify-active" && r.jobType != "stop") {
+			return r, nil
+		}
+		if mergeJobs(r.jobType, jobType) == "" {
+			if mode == "fail" {
+				return nil, fmt.Errorf("transaction for %s.service/%s is destructive (%s.service has '%s' job running, but '%s' is included in transaction)", d.name, jobType, d.name, r.jobType, jobType)
+			}
+			if jobType == "stop" {
+				// a stop aborts the running start, restart or reload, and runs once that has unwound
+				log.Printf("JOB: %d %s.service/%s canceled, replaced by %s", r.id, d.name, r.jobType, jobType)
+				r.abort()
+			}
+		}
+	}
+	ds.jobs.lastID++
+	j := &Job{
+		id:      ds.jobs.lastID,
+		d:       d,
+		jobType: jobType,
+		mode:    mode,
+		manual:  manual,
+		state:   "waiting",
+		cancel:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if u.running == nil {
+		ds.runJob(u, j)
+	} else {
+		u.waiting = j
+	}
+	return j, nil
+}
+
+// runJob starts the job in the background; called with the queue locked
+func (ds *daemons) runJob(u *unitJobs, j *Job) {
+	j.state = "running"
+	u.running = j
+	go func() {
+		err := j.run()
+		ds.jobs.Lock()
+		defer ds.jobs.Unlock()
+		if j.canceled {
+			err = errors.New("job canceled")
+		}
+		j.finish(err)
+		if u.running == j {
+			u.running = nil
+			if u.waiting != nil {
+				next := u.waiting
+				u.waiting = nil
+				ds.runJob(u, next)
+			}
+		}
+		if u.running == nil && u.waiting == nil && ds.jobs.units[j.d] == u {
+			delete(ds.jobs.units, j.d)
+		}
+	}()
+}
+
+// run carries out the job; a start or restart which was canceled on the way leaves the unit stopped
+func (j *Job) run() error {
+	d := j.d
+	ignoreDeps := j.mode == "ignore-dependencies" || j.mode == "ignore-requirements"
+	if j.cancel != nil && (j.jobType == "start" || j.jobType == "restart" || j.jobType == "reload-or-start") {
+		defer func() {
+			if j.isCanceled() && d.State() != StateStopped {
+				d.stop(true)
+			}
+		}()
+	}
+	switch j.jobType {
+	case "start":
+		err := d.startUnit(j.manual, ignoreDeps)
+		if err == nil && j.mode == "isolate" {
+			d.isolate()
+		}
+		return err
+	case "stop":
+		return d.Stop()
+	case "restart":
+		if !isActive(d.State()) {
+			// restarting a stopped unit starts it
+			return d.startUnit(j.manual, ignoreDeps)
+		}
+		return d.Restart()
+	case "reload":
+		return d.Reload()
+	case "reload-or-start":
+		if !isActive(d.State()) {
+			return d.startUnit(j.manual, ignoreDeps)
+		}
+		return d.Reload()
+	case "verify-active":
+		if !isActive(d.State()) {
+			return fmt.Errorf("unit %s.service is not active", d.name)
+		}
+	}
+	return nil
+}
+
+// Jobs returns the queued and running jobs, ordered by job ID
+func (ds *daemons) Jobs() []JobInfo {
+	ds.jobs.Lock()
+	defer ds.jobs.Unlock()
+	jobs := []JobInfo{}
+	for _, u := range ds.jobs.units {
+		for _, j := range []*Job{u.running, u.waiting} {
+			if j == nil || j.canceled {
+				continue
+			}
+			jobs = append(jobs, JobInfo{ID: j.id, Unit: j.d.name + ".service", Type: j.jobType, State: j.state})
+		}
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].ID < jobs[k].ID })
+	return jobs
+}
+
+// CancelJob cancels a queued job, or aborts a running start, restart or reload, which stops at its next phase and
+// leaves the unit stopped; a running stop cannot be canceled
+func (ds *daemons) CancelJob(id int) error {
+	ds.jobs.Lock()
+	defer ds.jobs.Unlock()
+	for _, u := range ds.jobs.units {
+		if j := u.waiting; j != nil && j.id == id {
+			u.waiting = nil
+			j.finish(errors.New("job canceled"))
+			log.Printf("JOB: %d %s.service/%s canceled", j.id, j.d.name, j.jobType)
+			return nil
+		}
+		if j := u.running; j != nil && j.id == id && !j.canceled {
+			if j.jobType == "stop" {
+				return fmt.Errorf("job %d is a running stop job and cannot be canceled", id)
+			}
+			j.abort()
+			log.Printf("JOB: %d %s.service/%s canceled", j.id, j.d.name, j.jobType)
+			return nil
+		}
+	}
+	return fmt.Errorf("job %d does not exist", id)
+}
+
+// abortJob aborts the job running for the unit, which stops at its next phase and leaves the unit stopped
+func (ds *daemons) abortJob(d *daemon) {
+	ds.jobs.Lock()
+	defer ds.jobs.Unlock()
+	if u, ok := ds.jobs.units[d]; ok && u.running != nil && !u.running.canceled {
+		j := u.running
+		log.Printf("JOB: %d %s.service/%s canceled, timed out", j.id, d.name, j.jobType)
+		j.abort()
+	}
+}
+
+// isCanceled reports whether the job was canceled
+func (j *Job) isCanceled() bool {
+	select {
+	case <-j.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// runningJob returns the job running for the unit, including one which was canceled and is still unwinding, or nil
+func (ds *daemons) runningJob(d *daemon) *Job {
+	ds.jobs.Lock()
+	defer ds.jobs.Unlock()
+	if u, ok := ds.jobs.units[d]; ok {
+		return u.running
+	}
+	return nil
+}
+
+// queueJob queues a job for the unit and waits for it to finish, or for cancel to be closed; without a manager, the
+// job is carried out directly. Must be called without the daemon lock held
+func (d *daemon) queueJob(jobType string, mode string, manual bool, cancel <-chan struct{}) error {
+	if d == nil {
+		return nil
+	}
+	if d.parent == nil {
+		return (&Job{d: d, jobType: jobType, mode: mode, manual: manual}).run()
+	}
+	j, err := d.parent.enqueue(d, jobType, mode, manual)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-j.done:
+		return j.err
+	case <-cancel:
+		return errors.New("job canceled")
+	}
+}
+
+// dependencyJob runs a job for a unit pulled in or affected by this one through the job queue, with the mode of the
+// job running for this unit, and waits for it. Must be called without the daemon lock held
+func (d *daemon) dependencyJob(dep *daemon, jobType string) error {
+	if dep == nil {
+		return nil
+	}
+	var j *Job
+	mode := "replace"
+	if d.parent != nil {
+		if j = d.parent.runningJob(d); j != nil {
+			if j.isCanceled() {
+				return errors.New("job canceled")
+			}
+			mode = j.mode
+		}
+	}
+	if mode == "isolate" {
+		// only the unit the job was queued for isolates
+		mode = "replace"
+	}
+	if j == nil {
+		return dep.queueJob(jobType, mode, false, nil)
+	}
+	depJob, err := d.parent.enqueue(dep, jobType, mode, false)
+	if err != nil {
+		return err
+	}
+	return d.parent.waitDependency(j, depJob)
+}
+
+// waitDependency waits for the dependency job to finish, or for the job j to be canceled; a dependency job which is
+// itself waiting for j, as in a dependency loop, is not waited for
+func (ds *daemons) waitDependency(j *Job, dep *Job) error {
+	ds.jobs.Lock()
+	if ds.waitsOn(dep, j) {
+		ds.jobs.Unlock()
+		log.Printf("JOB: %d %s.service/%s and %d %s.service/%s wait for each other, not waiting for %d", j.id, j.d.name,
+			j.jobType, dep.id, dep.d.name, dep.jobType, dep.id)
+		return nil
+	}
+	j.waitsFor = dep
+	ds.jobs.Unlock()
+	defer func() {
+		ds.jobs.Lock()
+		j.waitsFor = nil
+		ds.jobs.Unlock()
+	}()
+	select {
+	case <-dep.done:
+		return dep.err
+	case <-j.cancel:
+		return errors.New("job canceled")
+	}
+}
+
+// waitsOn reports whether the job j cannot finish before target: a running job waits for the dependency job it is
+// waiting for, a queued job for the job running for its unit. Called with the queue locked
+func (ds *daemons) waitsOn(j *Job, target *Job) bool {
+	seen := map[*Job]bool{}
+	for j != nil && !seen[j] {
+		if j == target {
+			return true
+		}
+		seen[j] = true
+		if j.state == "running" {
+			j = j.waitsFor
+		} else if u, ok := ds.jobs.units[j.d]; ok {
+			j = u.running
+		} else {
+			j = nil
+		}
+	}
+	return false
+}
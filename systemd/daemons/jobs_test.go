@@ -0,0 +1,141 @@
+package daemons
+
+import (
+	"docker-systemd/procwait"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestMergeJobs(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"start", "start", "start"},
+		{"stop", "stop", "stop"},
+		{"start", "stop", ""},
+		{"stop", "restart", ""},
+		{"reload", "stop", ""},
+		{"verify-active", "stop", ""},
+		{"start", "restart", "restart"},
+		{"reload", "restart", "restart"},
+		{"restart", "verify-active", "restart"},
+		{"start", "reload", "reload-or-start"},
+		{"reload", "start", "reload-or-start"},
+		{"reload-or-start", "start", "reload-or-start"},
+		{"reload-or-start", "reload", "reload-or-start"},
+		{"reload-or-start", "verify-active", "reload-or-start"},
+		{"reload-or-start", "restart", "restart"},
+		{"reload-or-start", "stop", ""},
+		{"start", "verify-active", "start"},
+		{"reload", "verify-active", "reload"},
+		{"verify-active", "verify-active", "verify-active"},
+	}
+	for _, tt := range tests {
+		if got := mergeJobs(tt.a, tt.b); got != tt.want {
+			t.Errorf("mergeJobs(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+		if got := mergeJobs(tt.b, tt.a); got != tt.want {
+			t.Errorf("mergeJobs(%q, %q) = %q, want %q", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+// newTestUnit adds a loaded oneshot unit without commands to the manager
+func newTestUnit(ds *daemons, name string) *daemon {
+	d := &daemon{
+		name:      name,
+		parent:    ds,
+		def:       newDaemonDef(),
+		loadState: LoadStateLoaded,
+		state:     StateStopped,
+	}
+	d.def.ServiceType = "oneshot"
+	d.def.RemainAfterExit = true
+	ds.list[name] = d
+	return d
+}
+
+func TestDependencyJobWaitsForRunningStart(t *testing.T) {
+	logToFile := LogToFile
+	LogToFile = false
+	defer func() { LogToFile = logToFile }()
+	procwait.Init()
+	marker := path.Join(t.TempDir(), "a-started")
+
+	ds := &daemons{list: make(map[string]*daemon)}
+	b := newTestUnit(ds, "b")
+	b.def.ExecStartPre = []string{"sleep 0.5; exit 1"}
+	b.def.ExecStart = []string{"true"}
+	a := newTestUnit(ds, "a")
+	a.def.ExecStart = []string{"touch " + marker}
+	a.def.Requires["b"] = b
+	b.def.RequiredBy["a"] = a
+
+	jb, err := ds.enqueue(b, "start", "replace", true)
+	if err != nil {
+		t.Fatalf("enqueue b: %s", err)
+	}
+	for i := 0; i < 100 && b.SubState() != SubStateStartPre; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sub := b.SubState(); sub != SubStateStartPre {
+		t.Fatalf("b did not reach start-pre, SubState = %s", sub)
+	}
+	ja, err := ds.enqueue(a, "start", "replace", true)
+	if err != nil {
+		t.Fatalf("enqueue a: %s", err)
+	}
+	if err := ja.Wait(); err == nil {
+		t.Errorf("start of a succeeded, want it to fail with its dependency b")
+	}
+	select {
+	case <-jb.done:
+	default:
+		t.Errorf("start of a finished before the start of b it depends on")
+	}
+	if err := jb.Wait(); err == nil {
+		t.Errorf("start of b succeeded, want its ExecStartPre= to fail it")
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Errorf("ExecStart= of a ran although its dependency b failed")
+	}
+	if st := a.ActiveState(); st == ActiveStateActive {
+		t.Errorf("a is %s after its dependency failed", st)
+	}
+}
+
+func TestWaitsOn(t *testing.T) {
+	ds := &daemons{list: make(map[string]*daemon)}
+	a, b, c := newTestUnit(ds, "a"), newTestUnit(ds, "b"), newTestUnit(ds, "c")
+	ja := &Job{d: a, jobType: "start", state: "running"}
+	jb := &Job{d: b, jobType: "start", state: "running"}
+	jbStop := &Job{d: b, jobType: "stop", state: "waiting"}
+	jc := &Job{d: c, jobType: "start", state: "running"}
+	ds.jobs.units = map[*daemon]*unitJobs{
+		a: {running: ja},
+		b: {running: jb, waiting: jbStop},
+		c: {running: jc},
+	}
+	ja.waitsFor = jb
+	if ds.waitsOn(jb, ja) {
+		t.Errorf("b waits on a, but b is not waiting for anything")
+	}
+	jb.waitsFor = jc
+	if !ds.waitsOn(ja, jc) {
+		t.Errorf("a does not wait on c, want a -> b -> c")
+	}
+	jc.waitsFor = ja
+	if !ds.waitsOn(jb, ja) {
+		t.Errorf("b does not wait on a, want b -> c -> a")
+	}
+	if !ds.waitsOn(jbStop, ja) {
+		t.Errorf("queued stop of b does not wait on a, want it to wait for the running start of b")
+	}
+	jc.waitsFor = nil
+	if ds.waitsOn(jbStop, ja) {
+		t.Errorf("queued stop of b waits on a, but nothing waits for a")
+	}
+}
@@ -3,18 +3,41 @@ package daemons
 import (
 	"docker-systemd/common"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"syscall"
 )
 
 var LogToStderr = false
 var LogToFile = true
 
+// bootMarks tracks the log files which received the boot marker of the current boot
+var bootMarks = struct {
+	sync.Mutex
+	bootID string
+	marked map[string]bool
+}{marked: make(map[string]bool)}
+
+// setBootID starts a new boot, unit logs get a boot marker line on their first write so journalctl -b can find it
+func setBootID(id string) {
+	bootMarks.Lock()
+	defer bootMarks.Unlock()
+	bootMarks.bootID = id
+	bootMarks.marked = make(map[string]bool)
+}
+
 type Logger struct {
-	f   *os.File
-	out *log.Logger
+	sync.Mutex
+	f        *os.File
+	out      *log.Logger
+	stream   *os.File // write end of the pipe handed to processes as stdout/stderr
+	streamID string   // JOURNAL_STREAM value, device:inode of the pipe
+	copying  sync.WaitGroup
+	closed   bool
 }
 
 func NewLogger(service string) (*Logger, error) {
@@ -32,6 +55,12 @@ func NewLogger(service string) (*Logger, error) {
 	if err != nil {
 		return nil, err
 	}
+	bootMarks.Lock()
+	if bootMarks.bootID != "" && !bootMarks.marked[destPath] {
+		bootMarks.marked[destPath] = true
+		f.WriteString(common.BootMarker(bootMarks.bootID) + "\n")
+	}
+	bootMarks.Unlock()
 	l := &Logger{
 		f:   f,
 		out: nlog,
@@ -54,6 +83,55 @@ func (l *Logger) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// Stream returns a pipe which is copied into the log, for use as stdout/stderr of processes, together with its
+// JOURNAL_STREAM identifier, so that processes can detect that their output is being logged
+func (l *Logger) Stream() (*os.File, string, error) {
+	l.Lock()
+	defer l.Unlock()
+	if l.stream != nil {
+		return l.stream, l.streamID, nil
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, "", err
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(w.Fd()), &st); err != nil {
+		r.Close()
+		w.Close()
+		return nil, "", err
+	}
+	l.stream = w
+	l.streamID = fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+	l.copying.Add(1)
+	go func() {
+		defer l.copying.Done()
+		defer r.Close()
+		io.Copy(l, r)
+	}()
+	return l.stream, l.streamID, nil
+}
+
+// Close closes the stream; the log file itself is closed once all processes holding the stream have exited
 func (l *Logger) Close() error {
-	return l.f.Close()
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if l.stream == nil {
+		if l.f == nil {
+			return nil
+		}
+		return l.f.Close()
+	}
+	err := l.stream.Close()
+	go func() {
+		l.copying.Wait()
+		if l.f != nil {
+			l.f.Close()
+		}
+	}()
+	return err
 }
@@ -0,0 +1,138 @@
+package daemons
+
+import (
+	"docker-systemd/procwait"
+	"docker-systemd/systemd/pidtracker"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bestmethod/inslice"
+	"github.com/mitchellh/go-ps"
+)
+
+// defaultStartTimeout is used when TimeoutStartSec= is not set, same as systemd's DefaultTimeoutStartSec=
+const defaultStartTimeout = 90 * time.Second
+
+// defaultStopTimeout is used when TimeoutStopSec= is not set
+const defaultStopTimeout = 5 * time.Second
+
+// processEnv returns the environment of a running process
+func processEnv(pid int) []string {
+	penviron, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/environ")
+	if err != nil {
+		return nil
+	}
+	return strings.Split(string(penviron), string([]byte{0}))
+}
+
+// belongsToUnit reports whether the process was started by the unit, either carrying the unit's environment
+// markers or being a tracked descendant of one of the launcher processes
+func belongsToUnit(pid int, name string, invocationID string, launchers []int) bool {
+	for _, launcher := range launchers {
+		if inslice.HasInt(pidtracker.Find(launcher), pid) {
+			return true
+		}
+	}
+	env := processEnv(pid)
+	if v, ok := envGet(env, "INVOCATION_ID"); ok && invocationID != "" && v == invocationID {
+		return true
+	}
+	if v, ok := envGet(env, "SYSTEMD_SERVICE_NAME"); ok && v == name {
+		return true
+	}
+	return false
+}
+
+// readPidFile reads and validates the main PID from the PIDFile= of the service
+func readPidFile(pidFile string, name string, invocationID string, launchers []int) (int, error) {
+	contents, err := os.ReadFile(pidFile)
+	if err != nil {
+		return 0, fmt.Errorf("PID file %s not readable (yet?): %s", pidFile, err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil || pid <= 1 {
+		return 0, fmt.Errorf("failed to parse PID from file %s", pidFile)
+	}
+	if !procwait.Is(pid) {
+		return 0, fmt.Errorf("PID %d read from file %s does not exist or is a zombie", pid, pidFile)
+	}
+	if !belongsToUnit(pid, name, invocationID, launchers) {
+		// same as systemd, a PID file written by root is trusted even if the process cannot be tied to the unit
+		var st syscall.Stat_t
+		if err := syscall.Stat(pidFile, &st); err != nil || st.Uid != 0 {
+			return 0, fmt.Errorf("new main PID %d does not belong to service, and PID file is not owned by root, refusing", pid)
+		}
+	}
+	return pid, nil
+}
+
+// waitPidFile polls for the PIDFile= to contain a valid PID until the timeout expires; returns 0 without an error
+// if the unit is stopped in the meantime
+func (d *daemon) waitPidFile(pidFile string, invocationID string, launchers []int, timeout time.Duration) (int, error) {
+	if timeout == 0 {
+		timeout = defaultStartTimeout
+	}
+	start := time.Now()
+	for {
+		pid, err := readPidFile(pidFile, d.name, invocationID, launchers)
+		if err == nil {
+			return pid, nil
+		}
+		if st := d.State(); st == StateStopping || st == StateStopped {
+			return 0, nil
+		}
+		if time.Since(start) > timeout {
+			return 0, fmt.Errorf("%s, start operation timed out", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// guessMainPids returns the top-most processes of the unit, that is processes started by the unit whose parent
+// process was not; used for forking services without PIDFile= when GuessMainPID= is enabled
+func guessMainPids(name string, invocationID string) []int {
+	processList, err := ps.Processes()
+	if err != nil {
+		return nil
+	}
+	parents := make(map[int]int)
+	for _, p := range processList {
+		if belongsToUnit(p.Pid(), name, invocationID, nil) {
+			parents[p.Pid()] = p.PPid()
+		}
+	}
+	pids := []int{}
+	for pid, ppid := range parents {
+		if _, ok := parents[ppid]; !ok {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// rereadPidFile updates the main PID from PIDFile= after a reload, as daemons may replace their main process
+func (d *daemon) rereadPidFile() {
+	d.RLock()
+	pidFile := d.def.PidFile
+	invocationID := d.invocationID
+	d.RUnlock()
+	if pidFile == "" {
+		return
+	}
+	pid, err := readPidFile(pidFile, d.name, invocationID, nil)
+	if err != nil {
+		log.Printf("<%s> %s", d.name, err)
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	if len(d.pids) > 0 && d.pids[0] != pid {
+		log.Printf("<%s> Main PID changed: %d => %d", d.name, d.pids[0], pid)
+		d.pids = []int{pid}
+	}
+}
@@ -0,0 +1,71 @@
+package daemons
+
+import (
+	"log"
+	"sort"
+)
+
+// isActive reports whether the state counts as active for dependency purposes
+func isActive(state DaemonState) bool {
+	return state == StateRunning || state == StateStarting || state == StateRestarting
+}
+
+// neededBy returns the names of the active units which pull in this unit through Wants=, Requires=, BindsTo= or Upholds=
+func (d *daemon) neededBy() []string {
+	d.RLock()
+	referrers := make(map[string]*daemon)
+	for _, deps := range []map[string]*daemon{d.def.WantedBy, d.def.RequiredBy, d.def.BoundBy, d.def.UpheldBy} {
+		for name, dep := range deps {
+			if dep != nil && dep != d {
+				referrers[name] = dep
+			}
+		}
+	}
+	d.RUnlock()
+	names := []string{}
+	for name, dep := range referrers {
+		if isActive(dep.State()) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NeededBy returns the names of the active units which pull in this unit
+func (d *daemon) NeededBy() []string {
+	return d.neededBy()
+}
+
+// releaseDeps is called once the unit deactivated, stopping the units it pulled in which have StopWhenUnneeded= set
+// and are not needed by any other active unit; must be called without the daemon lock held
+func (d *daemon) releaseDeps() {
+	d.RLock()
+	deps := []*daemon{}
+	for _, list := range []map[string]*daemon{d.def.Wants, d.def.Requires, d.def.BindsTo, d.def.Upholds} {
+		for _, dep := range list {
+			if dep != nil && dep != d {
+				deps = append(deps, dep)
+			}
+		}
+	}
+	d.RUnlock()
+	for _, dep := range deps {
+		dep.stopIfUnneeded()
+	}
+}
+
+// stopIfUnneeded stops a unit with StopWhenUnneeded= which was started as a dependency once no active unit needs it
+func (d *daemon) stopIfUnneeded() {
+	d.RLock()
+	unneeded := d.def.StopWhenUnneeded && !d.isManual && isActive(d.state)
+	d.RUnlock()
+	if !unneeded || d.isShuttingDown() || len(d.neededBy()) > 0 {
+		return
+	}
+	log.Printf("<%s> Unit not needed anymore, stopping", d.name)
+	err := d.queueJob("stop", "replace", false, nil)
+	if err != nil {
+		log.Printf("Failed to stop service as unneeded: %s: %s", d.name, err)
+	}
+}
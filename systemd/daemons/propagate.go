@@ -0,0 +1,111 @@
+package daemons
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+// depUnits returns the distinct units from the dependency lists, sorted by name and excluding the unit itself and units
+// which are not loaded; called with the daemon locked
+func (d *daemon) depUnits(lists ...map[string]*daemon) []*daemon {
+	seen := make(map[*daemon]bool)
+	units := []*daemon{}
+	for _, list := range lists {
+		for _, dep := range list {
+			if dep == nil || dep == d || seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			units = append(units, dep)
+		}
+	}
+	sort.Slice(units, func(i, j int) bool { return units[i].name < units[j].name })
+	return units
+}
+
+// activeUnits filters the units down to those which are active
+func activeUnits(units []*daemon) []*daemon {
+	active := []*daemon{}
+	for _, u := range units {
+		if isActive(u.State()) {
+			active = append(active, u)
+		}
+	}
+	return active
+}
+
+// stopDependents stops the active units depending on this one; units with BindsTo= are stopped whenever this unit
+// deactivates, while units with Requires=, Requisite=, PartOf= and StopPropagatedFrom= (or listed in PropagatesStopTo=) are only
+// stopped when this unit is stopped explicitly; must be called without the daemon lock held
+func (d *daemon) stopDependents(explicit bool) {
+	d.RLock()
+	deps := d.depUnits(d.def.BoundBy)
+	if explicit {
+		deps = d.depUnits(d.def.BoundBy, d.def.RequiredBy, d.def.RequisiteOf, d.def.ConsistsOf, d.def.PropagatesStopTo)
+	}
+	d.RUnlock()
+	for _, dep := range activeUnits(deps) {
+		log.Printf("<%s> Stopping dependent unit %s", d.name, dep.name)
+		err := d.dependencyJob(dep, "stop")
+		if err != nil {
+			log.Printf("Failed to stop dependency %s: %s", dep.name, err)
+		}
+	}
+}
+
+// restartDependents restarts the units with Requires=, Requisite=, BindsTo= or PartOf= on this unit which were active before
+// this unit was restarted; in a dependency loop, the restart job already running for a unit is not waited for
+func (d *daemon) restartDependents(deps []*daemon) {
+	for _, dep := range deps {
+		log.Printf("<%s> Restarting dependent unit %s", d.name, dep.name)
+		err := d.dependencyJob(dep, "restart")
+		if err != nil {
+			log.Printf("Failed to restart dependency %s: %s", dep.name, err)
+		}
+	}
+}
+
+// reloadPropagated reloads the active units listed in PropagatesReloadTo=, or with ReloadPropagatedFrom= on this unit
+func (d *daemon) reloadPropagated() {
+	d.RLock()
+	deps := d.depUnits(d.def.PropagatesReloadTo)
+	d.RUnlock()
+	for _, dep := range activeUnits(deps) {
+		log.Printf("<%s> Propagating reload to %s", d.name, dep.name)
+		err := d.dependencyJob(dep, "reload")
+		if err != nil {
+			log.Printf("Failed to reload %s: %s", dep.name, err)
+		}
+	}
+}
+
+// upheldBy returns the names of the active units which uphold this unit
+func (d *daemon) upheldBy() []string {
+	d.RLock()
+	deps := d.depUnits(d.def.UpheldBy)
+	d.RUnlock()
+	names := []string{}
+	for _, dep := range activeUnits(deps) {
+		names = append(names, dep.name)
+	}
+	return names
+}
+
+// uphold starts the unit again after it was stopped, if an active unit has Upholds= on it
+func (d *daemon) uphold() {
+	if d.isShuttingDown() || isActive(d.State()) {
+		return
+	}
+	upheldBy := d.upheldBy()
+	if len(upheldBy) == 0 {
+		return
+	}
+	log.Printf("<%s> Upheld by %s, starting", d.name, strings.Join(upheldBy, ", "))
+	go func() {
+		err := d.queueJob("start", "replace", false, nil)
+		if err != nil {
+			log.Printf("<%s> Upheld start failed: %s", d.name, err)
+		}
+	}()
+}
@@ -0,0 +1,249 @@
+package daemons
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Property is a systemd unit property as shown by systemctl show
+type Property struct {
+	Name  string
+	Value string
+}
+
+// Properties returns the properties of the unit in systemd's order and format; empty values are included
+func (d *daemon) Properties() []Property {
+	fileState := d.UnitFileState()
+	d.RLock()
+	defer d.RUnlock()
+	def := d.def
+	if def == nil {
+		def = newDaemonDef()
+	}
+	props := []Property{}
+	add := func(name string, value string) {
+		props = append(props, Property{name, value})
+	}
+	serviceType := def.ServiceType
+	if serviceType == "" {
+		serviceType = "simple"
+	}
+	restart := def.Restart
+	if restart == "" {
+		restart = "no"
+	}
+	restartSleep := def.RestartSleep
+	if restartSleep == 0 {
+		restartSleep = time.Second
+	}
+	startTimeout := def.StartTimeout
+	if startTimeout == 0 {
+		startTimeout = defaultStartTimeout
+	}
+	stopTimeout := def.StopTimeout
+	if stopTimeout == 0 {
+		stopTimeout = defaultStopTimeout
+	}
+	result := d.result
+	if result == "" {
+		result = ResultSuccess
+	}
+	add("Type", serviceType)
+	add("Restart", restart)
+	add("PIDFile", def.PidFile)
+	add("RemainAfterExit", formatBool(def.RemainAfterExit))
+	add("GuessMainPID", formatBool(def.GuessMainPID))
+	add("RestartUSec", formatTimespan(restartSleep))
+	add("TimeoutStartUSec", formatTimespan(startTimeout))
+	add("TimeoutStopUSec", formatTimespan(stopTimeout))
+	add("MainPID", strconv.Itoa(d.mainPid()))
+	add("ControlPID", strconv.Itoa(d.controlPid()))
+	add("Result", string(result))
+	add("NRestarts", strconv.Itoa(d.nRestarts))
+	code, status := 0, 0
+	if ws := d.exitStatus; ws != nil {
+		switch {
+		case ws.CoreDump():
+			code, status = 3, int(ws.Signal())
+		case ws.Signaled():
+			code, status = 2, int(ws.Signal())
+		default:
+			code, status = 1, ws.ExitStatus()
+		}
+	}
+	add("ExecMainCode", strconv.Itoa(code))
+	add("ExecMainStatus", strconv.Itoa(status))
+	for _, exec := range []struct {
+		name  string
+		lines []string
+	}{
+		{"ExecCondition", def.ExecCondition},
+		{"ExecStartPre", def.ExecStartPre},
+		{"ExecStart", def.ExecStart},
+		{"ExecStartPost", def.ExecStartPost},
+		{"ExecReload", def.ExecReload},
+		{"ExecStop", def.ExecStop},
+		{"ExecStopPost", def.ExecStopPost},
+	} {
+		if len(exec.lines) == 0 {
+			add(exec.name, "")
+		}
+		for _, line := range exec.lines {
+			add(exec.name, formatExec(line))
+		}
+	}
+	add("WorkingDirectory", def.WorkingDirectory)
+	add("User", def.User)
+	add("Group", def.Group)
+	add("Environment", FormatEnvironment(def.Env))
+	envFiles := []string{}
+	for _, f := range def.EnvFile {
+		ignore := strings.HasPrefix(f, "-")
+		envFiles = append(envFiles, fmt.Sprintf("%s (ignore_errors=%s)", strings.TrimPrefix(f, "-"), formatBool(ignore)))
+	}
+	add("EnvironmentFiles", strings.Join(envFiles, " "))
+	add("PassEnvironment", strings.Join(def.PassEnv, " "))
+	add("UnsetEnvironment", strings.Join(def.UnsetEnv, " "))
+	for _, limit := range []struct {
+		name  string
+		value string
+	}{
+		{"LimitCPU", def.LimitCpu}, {"LimitFSIZE", def.LimitFsize}, {"LimitDATA", def.LimitData},
+		{"LimitSTACK", def.LimitStack}, {"LimitCORE", def.LimitCore}, {"LimitRSS", def.LimitRss},
+		{"LimitNOFILE", def.LimitNoFile}, {"LimitAS", def.LimitAs}, {"LimitNPROC", def.LimitNProc},
+		{"LimitMEMLOCK", def.LimitMemLock}, {"LimitLOCKS", def.LimitLocks}, {"LimitSIGPENDING", def.LimitSigPending},
+		{"LimitMSGQUEUE", def.LimitMsgQueue}, {"LimitNICE", def.LimitNice}, {"LimitRTPRIO", def.LimitRtPrio},
+		{"LimitRTTIME", def.LimitRtTime},
+	} {
+		add(limit.name, limit.value)
+	}
+
+	add("Id", d.name+".service")
+	add("Names", strings.Join(append([]string{d.name + ".service"}, def.Alias...), " "))
+	deps := def.depMaps()
+	for _, setting := range []string{"Requires", "Requisite", "Wants", "BindsTo", "PartOf", "Upholds", "RequiredBy",
+		"RequisiteOf", "WantedBy", "BoundBy", "UpheldBy", "ConsistsOf", "Conflicts", "ConflictedBy", "Before", "After",
+		"OnFailure", "OnFailureOf", "OnSuccess", "OnSuccessOf", "PropagatesReloadTo", "ReloadPropagatedFrom",
+		"PropagatesStopTo", "StopPropagatedFrom"} {
+		add(setting, formatDeps(deps[setting]))
+	}
+	add("Description", def.Description)
+	add("LoadState", string(d.loadState))
+	add("ActiveState", string(d.activeState()))
+	sub := d.subState
+	if sub == "" {
+		sub = SubStateDead
+	}
+	add("SubState", string(sub))
+	add("FragmentPath", d.fragment)
+	add("DropInPaths", strings.Join(d.dropins, " "))
+	add("UnitFileState", string(fileState))
+	preset := ""
+	if d.loadState == LoadStateLoaded {
+		preset = VendorPreset(d.name + ".service")
+	}
+	add("UnitFilePreset", preset)
+	add("StateChangeTimestamp", formatTimestampProperty(d.stateChanged))
+	add("ActiveEnterTimestamp", formatTimestampProperty(d.activeEnter))
+	add("ActiveExitTimestamp", formatTimestampProperty(d.activeExit))
+	add("InactiveEnterTimestamp", formatTimestampProperty(d.inactiveEnter))
+	add("InactiveExitTimestamp", formatTimestampProperty(d.inactiveExit))
+	add("CanStart", formatBool(d.loadState == LoadStateLoaded))
+	add("CanStop", formatBool(d.loadState != LoadStateMasked))
+	add("CanReload", formatBool(len(def.ExecReload) > 0))
+	add("StopWhenUnneeded", formatBool(def.StopWhenUnneeded))
+	add("OnFailureJobMode", def.OnFailureJobMode)
+	add("OnSuccessJobMode", def.OnSuccessJobMode)
+	add("JobTimeoutUSec", formatTimespan(def.JobTimeout))
+	add("JobTimeoutAction", def.JobTimeoutAction)
+	add("ConditionResult", formatBool(d.conditionError == nil))
+	add("StartLimitIntervalUSec", formatTimespan(def.StartLimitInterval))
+	add("StartLimitBurst", strconv.Itoa(def.StartLimitBurst))
+	add("StartLimitAction", def.StartLimitAction)
+	add("FailureAction", def.FailureAction)
+	add("FailureActionExitStatus", strconv.Itoa(def.FailureActionExitStatus))
+	add("SuccessAction", def.SuccessAction)
+	add("SuccessActionExitStatus", strconv.Itoa(def.SuccessActionExitStatus))
+	add("InvocationID", d.invocationID)
+	return props
+}
+
+// FormatEnvironment formats VARIABLE=VALUE assignments as an Environment= property, quoting the ones with spaces
+func FormatEnvironment(env []string) string {
+	ret := []string{}
+	for _, e := range env {
+		if strings.ContainsAny(e, " \t\"") {
+			e = strconv.Quote(e)
+		}
+		ret = append(ret, e)
+	}
+	return strings.Join(ret, " ")
+}
+
+// formatBool formats a boolean property
+func formatBool(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// formatTimespan formats a duration the way systemd shows time spans, e.g. 1min 30s
+func formatTimespan(d time.Duration) string {
+	if d <= 0 {
+		return "0"
+	}
+	parts := []string{}
+	for _, unit := range []struct {
+		suffix string
+		size   time.Duration
+	}{
+		{"d", 24 * time.Hour}, {"h", time.Hour}, {"min", time.Minute}, {"s", time.Second},
+		{"ms", time.Millisecond}, {"us", time.Microsecond},
+	} {
+		if n := d / unit.size; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d%s", n, unit.suffix))
+			d -= n * unit.size
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// formatTimestampProperty formats a timestamp property, which is empty if the event did not happen yet
+func formatTimestampProperty(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return formatTimestamp(t)
+}
+
+// formatDeps returns the sorted unit names of a dependency setting
+func formatDeps(deps map[string]*daemon) string {
+	names := []string{}
+	for name := range deps {
+		if !isOtherUnitType(name) {
+			name += ".service"
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+// formatExec formats a command line in systemd's structured form; the runtime fields are not tracked per command
+func formatExec(line string) string {
+	ignoreErrors := false
+	for len(line) > 0 && strings.ContainsRune("-@+!:", rune(line[0])) {
+		ignoreErrors = ignoreErrors || line[0] == '-'
+		line = line[1:]
+	}
+	argv, err := splitQuoted(line)
+	if err != nil || len(argv) == 0 {
+		argv = []string{line}
+	}
+	return fmt.Sprintf("{ path=%s ; argv[]=%s ; ignore_errors=%s ; start_time=[n/a] ; stop_time=[n/a] ; pid=0 ; code=(null) ; status=0/0 }",
+		argv[0], strings.Join(argv, " "), formatBool(ignoreErrors))
+}
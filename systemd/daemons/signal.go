@@ -0,0 +1,68 @@
+package daemons
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// signalNames maps signals to their names without the SIG prefix, as used in EXIT_STATUS= and systemctl output
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:    "HUP",
+	syscall.SIGINT:    "INT",
+	syscall.SIGQUIT:   "QUIT",
+	syscall.SIGILL:    "ILL",
+	syscall.SIGTRAP:   "TRAP",
+	syscall.SIGABRT:   "ABRT",
+	syscall.SIGBUS:    "BUS",
+	syscall.SIGFPE:    "FPE",
+	syscall.SIGKILL:   "KILL",
+	syscall.SIGUSR1:   "USR1",
+	syscall.SIGSEGV:   "SEGV",
+	syscall.SIGUSR2:   "USR2",
+	syscall.SIGPIPE:   "PIPE",
+	syscall.SIGALRM:   "ALRM",
+	syscall.SIGTERM:   "TERM",
+	syscall.SIGSTKFLT: "STKFLT",
+	syscall.SIGCHLD:   "CHLD",
+	syscall.SIGCONT:   "CONT",
+	syscall.SIGSTOP:   "STOP",
+	syscall.SIGTSTP:   "TSTP",
+	syscall.SIGTTIN:   "TTIN",
+	syscall.SIGTTOU:   "TTOU",
+	syscall.SIGURG:    "URG",
+	syscall.SIGXCPU:   "XCPU",
+	syscall.SIGXFSZ:   "XFSZ",
+	syscall.SIGVTALRM: "VTALRM",
+	syscall.SIGPROF:   "PROF",
+	syscall.SIGWINCH:  "WINCH",
+	syscall.SIGIO:     "IO",
+	syscall.SIGPWR:    "PWR",
+	syscall.SIGSYS:    "SYS",
+}
+
+// signalName returns the short name of a signal, e.g. TERM, or the number for unknown and realtime signals
+func signalName(sig syscall.Signal) string {
+	if n, ok := signalNames[sig]; ok {
+		return n
+	}
+	return strconv.Itoa(int(sig))
+}
+
+// ParseSignal parses a signal given by name, with or without the SIG prefix, or by number
+func ParseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, fmt.Errorf("Failed to parse signal string %s.", s)
+		}
+		return syscall.Signal(n), nil
+	}
+	name := strings.TrimPrefix(s, "SIG")
+	for sig, n := range signalNames {
+		if n == name {
+			return sig, nil
+		}
+	}
+	return 0, fmt.Errorf("Failed to parse signal string %s.", s)
+}
@@ -0,0 +1,46 @@
+package daemons
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    syscall.Signal
+		wantErr bool
+	}{
+		{in: "TERM", want: syscall.SIGTERM},
+		{in: "SIGTERM", want: syscall.SIGTERM},
+		{in: "KILL", want: syscall.SIGKILL},
+		{in: "SIGHUP", want: syscall.SIGHUP},
+		{in: "USR2", want: syscall.SIGUSR2},
+		{in: "9", want: syscall.SIGKILL},
+		{in: "1", want: syscall.SIGHUP},
+		{in: "64", want: syscall.Signal(64)},
+		{in: "0", wantErr: true},
+		{in: "65", wantErr: true},
+		{in: "-15", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "SIG", wantErr: true},
+		{in: "term", wantErr: true},
+		{in: "BOGUS", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSignal(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseSignal(%q) = %d, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSignal(%q) returned error: %s", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSignal(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
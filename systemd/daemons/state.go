@@ -0,0 +1,210 @@
+package daemons
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// ActiveState is the systemd ActiveState= of a unit
+type ActiveState string
+
+// SubState is the systemd SubState= of a service
+type SubState string
+
+// Result is the systemd Result= of the last activation of a service
+type Result string
+
+const (
+	ActiveStateActive       = ActiveState("active")
+	ActiveStateReloading    = ActiveState("reloading")
+	ActiveStateInactive     = ActiveState("inactive")
+	ActiveStateFailed       = ActiveState("failed")
+	ActiveStateActivating   = ActiveState("activating")
+	ActiveStateDeactivating = ActiveState("deactivating")
+)
+
+const (
+	SubStateDead         = SubState("dead")
+	SubStateCondition    = SubState("condition")
+	SubStateStartPre     = SubState("start-pre")
+	SubStateStart        = SubState("start")
+	SubStateStartPost    = SubState("start-post")
+	SubStateRunning      = SubState("running")
+	SubStateExited       = SubState("exited")
+	SubStateReload       = SubState("reload")
+	SubStateStop         = SubState("stop")
+	SubStateStopSigterm  = SubState("stop-sigterm")
+	SubStateStopSigkill  = SubState("stop-sigkill")
+	SubStateStopPost     = SubState("stop-post")
+	SubStateFinalSigterm = SubState("final-sigterm")
+	SubStateAutoRestart  = SubState("auto-restart")
+	SubStateFailed       = SubState("failed")
+)
+
+const (
+	ResultSuccess       = Result("success")
+	ResultResources     = Result("resources")
+	ResultExitCode      = Result("exit-code")
+	ResultSignal        = Result("signal")
+	ResultTimeout       = Result("timeout")
+	ResultCoreDump      = Result("core-dump")
+	ResultWatchdog      = Result("watchdog")
+	ResultStartLimitHit = Result("start-limit-hit")
+)
+
+// subStates is the state machine of a service: each SubState belongs to one DaemonState and one ActiveState
+var subStates = map[SubState]struct {
+	state  DaemonState
+	active ActiveState
+}{
+	SubStateDead:         {StateStopped, ActiveStateInactive},
+	SubStateFailed:       {StateStopped, ActiveStateFailed},
+	SubStateCondition:    {StateStarting, ActiveStateActivating},
+	SubStateStartPre:     {StateStarting, ActiveStateActivating},
+	SubStateStart:        {StateStarting, ActiveStateActivating},
+	SubStateStartPost:    {StateStarting, ActiveStateActivating},
+	SubStateRunning:      {StateRunning, ActiveStateActive},
+	SubStateExited:       {StateRunning, ActiveStateActive},
+	SubStateReload:       {StateRunning, ActiveStateReloading},
+	SubStateStop:         {StateStopping, ActiveStateDeactivating},
+	SubStateStopSigterm:  {StateStopping, ActiveStateDeactivating},
+	SubStateStopSigkill:  {StateStopping, ActiveStateDeactivating},
+	SubStateStopPost:     {StateStopping, ActiveStateDeactivating},
+	SubStateFinalSigterm: {StateStopping, ActiveStateDeactivating},
+	SubStateAutoRestart:  {StateRestarting, ActiveStateActivating},
+}
+
+// setState moves the unit to the SubState, and with it to the matching DaemonState; called with the daemon locked
+func (d *daemon) setState(sub SubState) {
+	if from, to := d.activeState(), subStates[sub].active; from != to {
+		now := time.Now()
+		d.stateChanged = now
+		switch {
+		case isInactive(from):
+			d.inactiveExit = now
+		case from == ActiveStateActive || from == ActiveStateReloading:
+			if to != ActiveStateActive && to != ActiveStateReloading {
+				d.activeExit = now
+			}
+		}
+		switch {
+		case isInactive(to):
+			d.inactiveEnter = now
+		case to == ActiveStateActive && from != ActiveStateReloading:
+			d.activeEnter = now
+		}
+	}
+	d.subState = sub
+	d.state = subStates[sub].state
+}
+
+// isInactive returns true for the ActiveStates of a unit which is not running
+func isInactive(state ActiveState) bool {
+	return state == ActiveStateInactive || state == ActiveStateFailed
+}
+
+// setStage moves a unit which is still in the same DaemonState on to the next SubState, e.g. from start-pre to start;
+// a unit which was stopped in the meantime is left alone; called with the daemon locked
+func (d *daemon) setStage(sub SubState) {
+	if d.state == subStates[sub].state {
+		d.setState(sub)
+	}
+}
+
+// deactivate records the result of the activation and moves the unit to dead, or failed if the result is not
+// success; called with the daemon locked
+func (d *daemon) deactivate(result Result) {
+	d.result = result
+	if result == ResultSuccess {
+		d.setState(SubStateDead)
+	} else {
+		d.setState(SubStateFailed)
+	}
+}
+
+// activeState returns the ActiveState of the unit; called with the daemon locked
+func (d *daemon) activeState() ActiveState {
+	if d.subState == "" {
+		return ActiveStateInactive
+	}
+	return subStates[d.subState].active
+}
+
+// ActiveState returns the systemd ActiveState= of the unit
+func (d *daemon) ActiveState() ActiveState {
+	d.RLock()
+	defer d.RUnlock()
+	return d.activeState()
+}
+
+// SubState returns the systemd SubState= of the unit
+func (d *daemon) SubState() SubState {
+	d.RLock()
+	defer d.RUnlock()
+	if d.subState == "" {
+		return SubStateDead
+	}
+	return d.subState
+}
+
+// Result returns the result of the last activation of the unit
+func (d *daemon) Result() Result {
+	d.RLock()
+	defer d.RUnlock()
+	if d.result == "" {
+		return ResultSuccess
+	}
+	return d.result
+}
+
+// waitResult returns the result for a process exit status; termination by a clean signal is a success
+func waitResult(ws *syscall.WaitStatus) Result {
+	switch {
+	case ws == nil:
+		return ResultSuccess
+	case ws.CoreDump():
+		return ResultCoreDump
+	case ws.Signaled():
+		if isCleanSignal(ws.Signal()) {
+			return ResultSuccess
+		}
+		return ResultSignal
+	case ws.ExitStatus() != 0:
+		return ResultExitCode
+	}
+	return ResultSuccess
+}
+
+// failResult returns the result for a process which failed a start; a failure without an exit status, e.g. when the
+// command could not be executed, is reported as exit-code same as in systemd
+func failResult(ws *syscall.WaitStatus) Result {
+	if r := waitResult(ws); r != ResultSuccess {
+		return r
+	}
+	return ResultExitCode
+}
+
+// exitError describes how a process which did not succeed exited
+func exitError(ws *syscall.WaitStatus) error {
+	switch {
+	case ws.CoreDump():
+		return fmt.Errorf("process dumped core on signal %s", signalName(ws.Signal()))
+	case ws.Signaled():
+		return fmt.Errorf("process killed by signal %s", signalName(ws.Signal()))
+	}
+	return fmt.Errorf("process exited with error code %d", ws.ExitStatus())
+}
+
+// ResetFailed moves a failed unit back to inactive, and clears the last error and the start limit counters
+func (d *daemon) ResetFailed() {
+	d.Lock()
+	defer d.Unlock()
+	if d.subState == SubStateFailed {
+		d.deactivate(ResultSuccess)
+	}
+	if d.state == StateStopped {
+		d.stateError = nil
+	}
+	d.startTimes = nil
+}
@@ -0,0 +1,149 @@
+package daemons
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestStateTransitions(t *testing.T) {
+	d := &daemon{name: "test"}
+	if got := d.activeState(); got != ActiveStateInactive {
+		t.Fatalf("new unit ActiveState = %s, want %s", got, ActiveStateInactive)
+	}
+	steps := []struct {
+		sub    SubState
+		state  DaemonState
+		active ActiveState
+	}{
+		{SubStateStartPre, StateStarting, ActiveStateActivating},
+		{SubStateStart, StateStarting, ActiveStateActivating},
+		{SubStateRunning, StateRunning, ActiveStateActive},
+		{SubStateReload, StateRunning, ActiveStateReloading},
+		{SubStateRunning, StateRunning, ActiveStateActive},
+		{SubStateStop, StateStopping, ActiveStateDeactivating},
+		{SubStateStopSigterm, StateStopping, ActiveStateDeactivating},
+		{SubStateStopPost, StateStopping, ActiveStateDeactivating},
+		{SubStateFinalSigterm, StateStopping, ActiveStateDeactivating},
+	}
+	for _, st := range steps {
+		d.setState(st.sub)
+		if d.subState != st.sub || d.state != st.state || d.activeState() != st.active {
+			t.Errorf("setState(%s): got %s/%d/%s, want %s/%d/%s", st.sub, d.subState, d.state, d.activeState(),
+				st.sub, st.state, st.active)
+		}
+	}
+	if d.activeEnter.IsZero() || d.activeExit.IsZero() || d.inactiveExit.IsZero() {
+		t.Errorf("timestamps not recorded: activeEnter=%s activeExit=%s inactiveExit=%s", d.activeEnter, d.activeExit, d.inactiveExit)
+	}
+}
+
+func TestSetStageSkipsStoppedUnit(t *testing.T) {
+	d := &daemon{name: "test"}
+	d.setState(SubStateStartPre)
+	d.setStage(SubStateStart)
+	if d.subState != SubStateStart {
+		t.Fatalf("setStage(start) while starting: SubState = %s, want %s", d.subState, SubStateStart)
+	}
+	d.setState(SubStateStop)
+	d.setStage(SubStateStartPost)
+	if d.subState != SubStateStop {
+		t.Errorf("setStage(start-post) while stopping: SubState = %s, want %s", d.subState, SubStateStop)
+	}
+}
+
+func TestDeactivate(t *testing.T) {
+	tests := []struct {
+		result Result
+		sub    SubState
+		active ActiveState
+	}{
+		{ResultSuccess, SubStateDead, ActiveStateInactive},
+		{ResultExitCode, SubStateFailed, ActiveStateFailed},
+		{ResultSignal, SubStateFailed, ActiveStateFailed},
+		{ResultTimeout, SubStateFailed, ActiveStateFailed},
+		{ResultCoreDump, SubStateFailed, ActiveStateFailed},
+		{ResultWatchdog, SubStateFailed, ActiveStateFailed},
+		{ResultStartLimitHit, SubStateFailed, ActiveStateFailed},
+	}
+	for _, tt := range tests {
+		d := &daemon{name: "test"}
+		d.setState(SubStateRunning)
+		d.deactivate(tt.result)
+		if d.subState != tt.sub || d.activeState() != tt.active || d.state != StateStopped || d.result != tt.result {
+			t.Errorf("deactivate(%s): got %s/%s/%s, want %s/%s/%s", tt.result, d.subState, d.activeState(), d.result,
+				tt.sub, tt.active, tt.result)
+		}
+	}
+	d := &daemon{name: "test"}
+	d.deactivate(ResultExitCode)
+	d.ResetFailed()
+	if d.subState != SubStateDead || d.result != ResultSuccess {
+		t.Errorf("ResetFailed: got %s/%s, want %s/%s", d.subState, d.result, SubStateDead, ResultSuccess)
+	}
+}
+
+func TestWaitResult(t *testing.T) {
+	exited := func(code int) *syscall.WaitStatus {
+		ws := syscall.WaitStatus(code << 8)
+		return &ws
+	}
+	signaled := func(sig syscall.Signal, core bool) *syscall.WaitStatus {
+		ws := syscall.WaitStatus(sig)
+		if core {
+			ws |= 0x80
+		}
+		return &ws
+	}
+	tests := []struct {
+		name string
+		ws   *syscall.WaitStatus
+		want Result
+		fail Result
+	}{
+		{"no status", nil, ResultSuccess, ResultExitCode},
+		{"exit 0", exited(0), ResultSuccess, ResultExitCode},
+		{"exit 1", exited(1), ResultExitCode, ResultExitCode},
+		{"SIGTERM", signaled(syscall.SIGTERM, false), ResultSuccess, ResultExitCode},
+		{"SIGKILL", signaled(syscall.SIGKILL, false), ResultSignal, ResultSignal},
+		{"SIGSEGV core", signaled(syscall.SIGSEGV, true), ResultCoreDump, ResultCoreDump},
+	}
+	for _, tt := range tests {
+		if got := waitResult(tt.ws); got != tt.want {
+			t.Errorf("waitResult(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+		if got := failResult(tt.ws); got != tt.fail {
+			t.Errorf("failResult(%s) = %s, want %s", tt.name, got, tt.fail)
+		}
+	}
+}
+
+func TestRestarts(t *testing.T) {
+	tests := []struct {
+		restart         string
+		result          Result
+		remainAfterExit bool
+		want            bool
+	}{
+		{"no", ResultExitCode, false, false},
+		{"always", ResultSuccess, false, true},
+		{"on-success", ResultSuccess, false, true},
+		{"on-success", ResultSuccess, true, false},
+		{"on-success", ResultExitCode, false, false},
+		{"on-failure", ResultSuccess, false, false},
+		{"on-failure", ResultExitCode, false, true},
+		{"on-failure", ResultWatchdog, false, true},
+		{"on-abnormal", ResultExitCode, false, false},
+		{"on-abnormal", ResultSignal, false, true},
+		{"on-abnormal", ResultTimeout, false, true},
+		{"on-abnormal", ResultWatchdog, false, true},
+		{"on-watchdog", ResultSignal, false, false},
+		{"on-watchdog", ResultWatchdog, false, true},
+		{"on-abort", ResultCoreDump, false, true},
+		{"on-abort", ResultTimeout, false, false},
+	}
+	for _, tt := range tests {
+		if got := restarts(tt.restart, tt.result, tt.remainAfterExit); got != tt.want {
+			t.Errorf("restarts(%q, %s, %t) = %t, want %t", tt.restart, tt.result, tt.remainAfterExit, got, tt.want)
+		}
+	}
+}
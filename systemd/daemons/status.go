@@ -0,0 +1,456 @@
+package daemons
+
+import (
+	"bytes"
+	"docker-systemd/common"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// StatusOptions controls the output of Status
+type StatusOptions struct {
+	Lines   int  // number of log lines to show
+	Full    bool // do not ellipsize the process tree and log lines
+	Color   bool
+	Columns int // width of the terminal, 0 if the output is not a terminal
+}
+
+// UnitStatus is the status of a unit, as shown by systemctl status; timestamps are in microseconds since the epoch
+// and 0 if the event did not happen yet
+type UnitStatus struct {
+	Unit                 string        `json:"unit"`
+	Description          string        `json:"description"`
+	LoadState            LoadState     `json:"load_state"`
+	LoadMessages         []string      `json:"load_messages"`
+	FragmentPath         string        `json:"fragment_path"`
+	UnitFileState        UnitFileState `json:"unit_file_state"`
+	UnitFilePreset       string        `json:"unit_file_preset"`
+	DropInPaths          []string      `json:"drop_in_paths"`
+	ActiveState          ActiveState   `json:"active_state"`
+	SubState             SubState      `json:"sub_state"`
+	Result               Result        `json:"result"`
+	StateChangeTimestamp int64         `json:"state_change_timestamp"`
+	ConditionFailed      string        `json:"condition_failed"`
+	Error                string        `json:"error"`
+	NeededBy             []string      `json:"needed_by"`
+	MainPID              int           `json:"main_pid"`
+	ControlPID           int           `json:"control_pid"`
+	Tasks                int           `json:"tasks"`
+	MemoryBytes          uint64        `json:"memory_bytes"`
+	CPUUsec              uint64        `json:"cpu_usec"`
+	Processes            []Process     `json:"processes"`
+	Log                  []string      `json:"log"`
+}
+
+// Process is a running process of a unit
+type Process struct {
+	PID     int    `json:"pid"`
+	PPID    int    `json:"ppid"`
+	Command string `json:"command"`
+}
+
+const (
+	ansiHighlightRed   = "\x1b[0;1;31m"
+	ansiHighlightGreen = "\x1b[0;1;32m"
+	ansiNormal         = "\x1b[0m"
+)
+
+// clockTicks is the unit of the CPU times in /proc/PID/stat, USER_HZ is 100 on all Linux architectures
+const clockTicks = 100
+
+// StatusInfo returns the status of the unit with the last lines of its log
+func (d *daemon) StatusInfo(lines int) UnitStatus {
+	fileState := d.UnitFileState()
+	neededBy := d.neededBy()
+	d.RLock()
+	defer d.RUnlock()
+	sub := d.subState
+	if sub == "" {
+		sub = SubStateDead
+	}
+	result := d.result
+	if result == "" {
+		result = ResultSuccess
+	}
+	s := UnitStatus{
+		Unit:          d.name + ".service",
+		LoadState:     d.loadState,
+		LoadMessages:  append([]string{}, d.loadMessages...),
+		FragmentPath:  d.fragment,
+		UnitFileState: fileState,
+		DropInPaths:   append([]string{}, d.dropins...),
+		ActiveState:   d.activeState(),
+		SubState:      sub,
+		Result:        result,
+		NeededBy:      neededBy,
+		MainPID:       d.mainPid(),
+		ControlPID:    d.controlPid(),
+		Processes:     []Process{},
+		Log:           []string{},
+	}
+	if d.def != nil {
+		s.Description = d.def.Description
+	}
+	switch fileState {
+	case UnitFileStatic, UnitFileAlias, UnitFileGenerated:
+	default:
+		s.UnitFilePreset = VendorPreset(s.Unit)
+	}
+	if !d.stateChanged.IsZero() {
+		s.StateChangeTimestamp = d.stateChanged.UnixMicro()
+	}
+	if sub == SubStateDead && d.conditionError != nil {
+		s.ConditionFailed = d.conditionError.Error()
+	}
+	if d.stateError != nil {
+		s.Error = d.stateError.Error()
+	}
+	pids := d.unitPids()
+	if s.ControlPID != 0 {
+		pids = append(pids, s.ControlPID)
+	}
+	for _, pid := range procDescendants(pids) {
+		rss, ticks := procUsage(pid)
+		s.MemoryBytes += rss
+		s.CPUUsec += ticks * 1000000 / clockTicks
+		ppid := 0
+		if fields := procStat(pid); len(fields) > 1 {
+			ppid, _ = strconv.Atoi(fields[1])
+		}
+		s.Processes = append(s.Processes, Process{PID: pid, PPID: ppid, Command: procCmdline(pid)})
+	}
+	s.Tasks = len(s.Processes)
+	if lines > 0 {
+		s.Log = tailLog(path.Join(common.GetLogPath(), common.GetUnitLogPath(d.name)), lines)
+	}
+	return s
+}
+
+// Status returns the status of the unit in the layout of systemctl status
+func (d *daemon) Status(opts StatusOptions) string {
+	s := d.StatusInfo(opts.Lines)
+	colored := func(on string, text string) string {
+		if !opts.Color || on == "" {
+			return text
+		}
+		return on + text + ansiNormal
+	}
+	ellipsize := func(text string) string {
+		if opts.Full || opts.Columns <= 0 || utf8.RuneCountInString(text) <= opts.Columns {
+			return text
+		}
+		return string([]rune(text)[:opts.Columns-1]) + "…"
+	}
+	lines := []string{}
+	field := func(name string, value string) {
+		lines = append(lines, fmt.Sprintf("%12s %s", name+":", value))
+	}
+	more := func(value string) {
+		lines = append(lines, strings.Repeat(" ", 13)+value)
+	}
+
+	bullet, on := "●", ""
+	switch s.ActiveState {
+	case ActiveStateActive, ActiveStateReloading:
+		on = ansiHighlightGreen
+	case ActiveStateFailed:
+		on = ansiHighlightRed
+	case ActiveStateInactive:
+		bullet = "○"
+	}
+	title := colored(on, bullet) + " " + s.Unit
+	if s.Description != "" {
+		title += " - " + s.Description
+	}
+	lines = append(lines, title)
+
+	switch s.LoadState {
+	case LoadStateLoaded:
+		info := []string{s.FragmentPath, string(s.UnitFileState)}
+		if s.UnitFilePreset != "" {
+			info = append(info, "vendor preset: "+s.UnitFilePreset)
+		}
+		field("Loaded", "loaded ("+strings.Join(info, "; ")+")")
+	case LoadStateMasked:
+		field("Loaded", colored(ansiHighlightRed, "masked")+fmt.Sprintf(" (Reason: Unit %s is masked.)", s.Unit))
+	case LoadStateNotFound:
+		field("Loaded", colored(ansiHighlightRed, "not-found")+fmt.Sprintf(" (Reason: Unit %s not found.)", s.Unit))
+	case LoadStateBadSetting:
+		field("Loaded", colored(ansiHighlightRed, "bad-setting")+fmt.Sprintf(" (Reason: Unit %s has a bad unit file setting.)", s.Unit))
+	default:
+		field("Loaded", colored(ansiHighlightRed, string(s.LoadState))+fmt.Sprintf(" (Reason: Unit %s failed to load properly.)", s.Unit))
+	}
+	for _, msg := range s.LoadMessages {
+		more(msg)
+	}
+	dropinDirs := []string{}
+	dropinFiles := map[string][]string{}
+	for _, p := range s.DropInPaths {
+		dir, file := path.Split(p)
+		dir = strings.TrimSuffix(dir, "/")
+		if _, ok := dropinFiles[dir]; !ok {
+			dropinDirs = append(dropinDirs, dir)
+		}
+		dropinFiles[dir] = append(dropinFiles[dir], file)
+	}
+	for i, dir := range dropinDirs {
+		if i == 0 {
+			field("Drop-In", dir)
+		} else {
+			more(dir)
+		}
+		more("└─" + strings.Join(dropinFiles[dir], ", "))
+	}
+
+	state := string(s.ActiveState) + " (" + string(s.SubState) + ")"
+	if s.SubState == SubStateFailed {
+		state = string(s.ActiveState) + " (Result: " + string(s.Result) + ")"
+	}
+	switch s.ActiveState {
+	case ActiveStateActive, ActiveStateReloading:
+		state = colored(ansiHighlightGreen, state)
+	case ActiveStateFailed:
+		state = colored(ansiHighlightRed, state)
+	}
+	changed := time.UnixMicro(s.StateChangeTimestamp)
+	if s.StateChangeTimestamp != 0 {
+		state += " since " + formatTimestamp(changed) + "; " + formatRelative(changed) + " ago"
+	}
+	field("Active", state)
+	if s.ConditionFailed != "" {
+		field("Condition", "start condition failed at "+formatTimestamp(changed)+"; "+formatRelative(changed)+" ago")
+		more("└─ " + s.ConditionFailed)
+	}
+	if s.Error != "" {
+		field("Error", s.Error)
+	}
+	if len(s.NeededBy) > 0 {
+		field("Needed by", strings.Join(s.NeededBy, ", "))
+	}
+	if s.MainPID != 0 {
+		field("Main PID", fmt.Sprintf("%d (%s)", s.MainPID, procComm(s.MainPID)))
+	}
+	if s.ControlPID != 0 {
+		field("Cntrl PID", fmt.Sprintf("%d (%s)", s.ControlPID, procComm(s.ControlPID)))
+	}
+	if s.Tasks > 0 {
+		field("Tasks", strconv.Itoa(s.Tasks))
+		field("Memory", formatBytes(s.MemoryBytes))
+		field("CPU", formatCPU(time.Duration(s.CPUUsec)*time.Microsecond))
+		field("CGroup", "/system.slice/"+s.Unit)
+		for _, line := range procTree(s.Processes) {
+			lines = append(lines, ellipsize(strings.Repeat(" ", 13)+line))
+		}
+	}
+
+	if len(s.Log) > 0 {
+		lines = append(lines, "")
+		for _, line := range s.Log {
+			lines = append(lines, ellipsize(line))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatTimestamp formats a time the way systemd shows timestamps
+func formatTimestamp(t time.Time) string {
+	return t.Format("Mon 2006-01-02 15:04:05 MST")
+}
+
+// formatRelative returns the time passed since t with the two most significant units, e.g. 2min 5s
+func formatRelative(t time.Time) string {
+	d := time.Since(t)
+	days, hours, mins, secs := int(d.Hours())/24, int(d.Hours())%24, int(d.Minutes())%60, int(d.Seconds())%60
+	switch {
+	case days > 1:
+		return fmt.Sprintf("%d days %dh", days, hours)
+	case days == 1:
+		return fmt.Sprintf("1 day %dh", hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dmin", hours, mins)
+	case mins > 0:
+		return fmt.Sprintf("%dmin %ds", mins, secs)
+	case secs > 0:
+		return fmt.Sprintf("%ds", secs)
+	}
+	return fmt.Sprintf("%dms", d.Milliseconds())
+}
+
+// formatBytes formats a size with a binary unit suffix, e.g. 1.5M
+func formatBytes(b uint64) string {
+	if b < 1024 {
+		return fmt.Sprintf("%dB", b)
+	}
+	v := float64(b)
+	for _, unit := range []string{"K", "M", "G", "T"} {
+		v /= 1024
+		if v < 1024 || unit == "T" {
+			return fmt.Sprintf("%.1f%s", v, unit)
+		}
+	}
+	return ""
+}
+
+// formatCPU formats a CPU time, e.g. 15ms, 1.250s or 2min 3.500s
+func formatCPU(d time.Duration) string {
+	switch {
+	case d < time.Second:
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	case d < time.Minute:
+		return fmt.Sprintf("%.3fs", d.Seconds())
+	}
+	return fmt.Sprintf("%dmin %.3fs", int(d.Minutes()), d.Seconds()-float64(int(d.Minutes())*60))
+}
+
+// procStat returns the fields of /proc/PID/stat following the command name, the first one being the process state
+func procStat(pid int) []string {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil
+	}
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 {
+		return nil
+	}
+	return strings.Fields(string(stat[i+1:]))
+}
+
+// procComm returns the command name of the process
+func procComm(pid int) string {
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return "n/a"
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+// procCmdline returns the command line of the process, or its command name in brackets for kernel threads and zombies
+func procCmdline(pid int) string {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil || len(cmdline) == 0 {
+		return "[" + procComm(pid) + "]"
+	}
+	return strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+}
+
+// procUsage returns the resident memory in bytes and the CPU time in clock ticks used by the process
+func procUsage(pid int) (rss uint64, ticks uint64) {
+	if statm, err := os.ReadFile(fmt.Sprintf("/proc/%d/statm", pid)); err == nil {
+		if fields := strings.Fields(string(statm)); len(fields) > 1 {
+			pages, _ := strconv.ParseUint(fields[1], 10, 64)
+			rss = pages * uint64(os.Getpagesize())
+		}
+	}
+	if fields := procStat(pid); len(fields) > 12 {
+		utime, _ := strconv.ParseUint(fields[11], 10, 64)
+		stime, _ := strconv.ParseUint(fields[12], 10, 64)
+		ticks = utime + stime
+	}
+	return rss, ticks
+}
+
+// procDescendants returns the processes which are alive, together with all their descendants
+func procDescendants(pids []int) []int {
+	entries, _ := os.ReadDir("/proc")
+	parents := map[int]int{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if fields := procStat(pid); len(fields) > 1 {
+			parents[pid], _ = strconv.Atoi(fields[1])
+		}
+	}
+	in := map[int]bool{}
+	for _, pid := range pids {
+		if _, ok := parents[pid]; ok {
+			in[pid] = true
+		}
+	}
+	for added := true; added; {
+		added = false
+		for pid, ppid := range parents {
+			if in[ppid] && !in[pid] {
+				in[pid] = true
+				added = true
+			}
+		}
+	}
+	ret := []int{}
+	for pid := range in {
+		ret = append(ret, pid)
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+// procTree returns the processes as a tree following their parent processes, e.g. ├─123 /bin/sh -c ...
+func procTree(procs []Process) []string {
+	children := map[int][]Process{}
+	roots := []Process{}
+	for _, p := range procs {
+		found := false
+		for _, parent := range procs {
+			found = found || parent.PID == p.PPID
+		}
+		if found {
+			children[p.PPID] = append(children[p.PPID], p)
+		} else {
+			roots = append(roots, p)
+		}
+	}
+	lines := []string{}
+	var walk func(procs []Process, prefix string)
+	walk = func(procs []Process, prefix string) {
+		for i, p := range procs {
+			branch, indent := "├─", "│ "
+			if i == len(procs)-1 {
+				branch, indent = "└─", "  "
+			}
+			lines = append(lines, fmt.Sprintf("%s%s%d %s", prefix, branch, p.PID, p.Command))
+			walk(children[p.PID], prefix+indent)
+		}
+	}
+	walk(roots, "")
+	return lines
+}
+
+// tailLog returns the last lines of the unit log, without the boot markers
+func tailLog(logFile string, n int) []string {
+	f, err := os.Open(logFile)
+	if err != nil {
+		return []string{}
+	}
+	defer f.Close()
+	const chunk = 64 * 1024
+	partial := false
+	if fi, err := f.Stat(); err == nil && fi.Size() > chunk {
+		f.Seek(fi.Size()-chunk, io.SeekStart)
+		partial = true
+	}
+	buf, _ := io.ReadAll(f)
+	all := strings.Split(strings.TrimRight(string(buf), "\n"), "\n")
+	if partial {
+		// the first line was cut by the seek
+		all = all[1:]
+	}
+	lines := []string{}
+	for _, line := range all {
+		if line == "" || (strings.HasPrefix(line, "-- Boot ") && strings.HasSuffix(line, " --")) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
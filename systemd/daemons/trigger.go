@@ -0,0 +1,58 @@
+package daemons
+
+import (
+	"log"
+)
+
+// trigger queues a start job for a unit listed in OnFailure= or OnSuccess= with the job mode, passing it the MONITOR_*
+// variables; queued in the background, as the triggering unit is locked
+func (d *daemon) trigger(setting string, name string, target *daemon, mode string) {
+	if target == nil {
+		log.Printf("<%s> %s dependency %s not found", d.name, setting, name)
+		return
+	}
+	d.setMonitorEnv(target)
+	go func() {
+		err := target.queueJob("start", mode, false, nil)
+		if err != nil {
+			log.Printf("<%s> %s dependency %s start failed: %s", d.name, setting, name, err)
+		}
+	}()
+}
+
+// isolate stops all active units other than this unit and the units it pulls in, as for the isolate job mode
+func (d *daemon) isolate() {
+	if d.parent == nil {
+		return
+	}
+	keep := make(map[*daemon]bool)
+	var walk func(u *daemon)
+	walk = func(u *daemon) {
+		if keep[u] {
+			return
+		}
+		keep[u] = true
+		u.RLock()
+		deps := u.depUnits(u.def.Wants, u.def.Requires, u.def.BindsTo, u.def.Upholds)
+		u.RUnlock()
+		for _, dep := range deps {
+			walk(dep)
+		}
+	}
+	walk(d)
+	d.parent.RLock()
+	units := []*daemon{}
+	for _, u := range d.parent.list {
+		if !keep[u] {
+			units = append(units, u)
+		}
+	}
+	d.parent.RUnlock()
+	for _, u := range activeUnits(units) {
+		log.Printf("<%s> Isolating, stopping %s", d.name, u.name)
+		err := d.dependencyJob(u, "stop")
+		if err != nil {
+			log.Printf("Failed to stop %s: %s", u.name, err)
+		}
+	}
+}
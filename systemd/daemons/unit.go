@@ -3,477 +3,755 @@ package daemons
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"io"
+	"log"
+	"math"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/bestmethod/inslice"
 )
 
-func loadUnitFile(d *daemon, r io.Reader) error {
-	const (
-		sectionNone    = 1
-		sectionUnit    = 2
-		sectionService = 3
-		sectionInstall = 4
-		sectionUnknown = 5
-	)
+// infinity is used for time spans configured as 'infinity'
+const infinity = time.Duration(math.MaxInt64)
+
+// unsupportedKeys are valid systemd settings which are accepted but have no effect inside a container
+var unsupportedKeys = []string{
+	// [Unit]
+	"DOCUMENTATION", "DEFAULTDEPENDENCIES", "IGNOREONISOLATE", "REFUSEMANUALSTART", "REFUSEMANUALSTOP", "ALLOWISOLATE",
+	"JOBRUNNINGTIMEOUTSEC", "REBOOTARGUMENT", "JOBTIMEOUTREBOOTARGUMENT", "STARTLIMITREBOOTARGUMENT", "SOURCEPATH", "COLLECTMODE", "REQUIRESMOUNTSFOR", "WANTSMOUNTSFOR",
+	// [Service]
+	"KILLMODE", "KILLSIGNAL", "SENDSIGHUP", "SENDSIGKILL", "FINALKILLSIGNAL", "WATCHDOGSEC", "NOTIFYACCESS",
+	"RESTARTPREVENTEXITSTATUS", "RESTARTFORCEEXITSTATUS", "SUCCESSEXITSTATUS", "PERMISSIONSSTARTONLY",
+	"ROOTDIRECTORY", "UMASK", "NICE", "OOMSCOREADJUST", "IOSCHEDULINGCLASS", "IOSCHEDULINGPRIORITY", "CPUSCHEDULINGPOLICY",
+	"CPUSCHEDULINGPRIORITY", "CPUAFFINITY", "SUPPLEMENTARYGROUPS", "DYNAMICUSER", "PAMNAME", "CAPABILITYBOUNDINGSET",
+	"AMBIENTCAPABILITIES", "NONEWPRIVILEGES", "SECUREBITS", "PRIVATETMP", "PRIVATEDEVICES", "PRIVATENETWORK",
+	"PRIVATEUSERS", "PROTECTSYSTEM", "PROTECTHOME", "PROTECTKERNELTUNABLES", "PROTECTKERNELMODULES", "PROTECTKERNELLOGS",
+	"PROTECTCONTROLGROUPS", "PROTECTCLOCK", "PROTECTHOSTNAME", "PROTECTPROC", "PROCSUBSET", "READWRITEPATHS",
+	"READONLYPATHS", "INACCESSIBLEPATHS", "RESTRICTADDRESSFAMILIES", "RESTRICTNAMESPACES", "RESTRICTREALTIME",
+	"RESTRICTSUIDSGID", "LOCKPERSONALITY", "MEMORYDENYWRITEEXECUTE", "SYSTEMCALLFILTER", "SYSTEMCALLARCHITECTURES",
+	"SYSTEMCALLERRORNUMBER", "REMOVEIPC", "KEYRINGMODE", "STANDARDINPUT", "STANDARDOUTPUT", "STANDARDERROR",
+	"SYSLOGIDENTIFIER", "SYSLOGFACILITY", "SYSLOGLEVEL", "SYSLOGLEVELPREFIX", "TTYPATH", "TTYRESET", "TTYVHANGUP",
+	"RUNTIMEDIRECTORY", "RUNTIMEDIRECTORYMODE", "RUNTIMEDIRECTORYPRESERVE", "STATEDIRECTORY", "STATEDIRECTORYMODE",
+	"CACHEDIRECTORY", "CACHEDIRECTORYMODE", "LOGSDIRECTORY", "LOGSDIRECTORYMODE", "CONFIGURATIONDIRECTORY",
+	"CONFIGURATIONDIRECTORYMODE", "SLICE", "DELEGATE", "CPUACCOUNTING", "CPUQUOTA", "CPUWEIGHT", "CPUSHARES",
+	"MEMORYACCOUNTING", "MEMORYMAX", "MEMORYHIGH", "MEMORYLOW", "MEMORYLIMIT", "TASKSACCOUNTING", "TASKSMAX",
+	"IOACCOUNTING", "IOWEIGHT", "BLOCKIOACCOUNTING", "DEVICEALLOW", "DEVICEPOLICY", "IPADDRESSALLOW", "IPADDRESSDENY",
+	"OOMPOLICY", "FILEDESCRIPTORSTOREMAX", "USBFUNCTIONDESCRIPTORS", "USBFUNCTIONSTRINGS", "SOCKETS", "BUSNAME",
+	"UTMPIDENTIFIER", "UTMPMODE", "IGNORESIGPIPE", "LOGLEVELMAX", "LOGEXTRAFIELDS", "LOGRATELIMITINTERVALSEC",
+	"LOGRATELIMITBURST", "TIMERSLACKNSEC", "PERSONALITY", "MOUNTFLAGS", "BINDPATHS", "BINDREADONLYPATHS",
+	"TEMPORARYFILESYSTEM", "PRIVATEMOUNTS", "PRIVATEIPC", "NETWORKNAMESPACEPATH", "IPCNAMESPACEPATH",
+}
+
+// unitParser holds the state of parsing a single unit file or drop-in, for line-numbered diagnostics
+type unitParser struct {
+	d       *daemon
+	fname   string
+	lineNo  int
+	section string
+	bad     bool
+}
+
+// warn logs a parse diagnostic and records it against the unit
+func (p *unitParser) warn(format string, args ...any) {
+	msg := fmt.Sprintf("%s:%d: %s", p.fname, p.lineNo, fmt.Sprintf(format, args...))
+	log.Printf("<%s> %s", p.d.name, msg)
+	p.d.loadMessages = append(p.d.loadMessages, msg)
+}
+
+func newDaemonDef() *daemondef {
+	return &daemondef{
+		Wants:        make(map[string]*daemon),
+		WantedBy:     make(map[string]*daemon),
+		Requires:     make(map[string]*daemon),
+		RequiredBy:   make(map[string]*daemon),
+		Requisite:    make(map[string]*daemon),
+		RequisiteOf:  make(map[string]*daemon),
+		BindsTo:      make(map[string]*daemon),
+		BoundBy:      make(map[string]*daemon),
+		PartOf:       make(map[string]*daemon),
+		ConsistsOf:   make(map[string]*daemon),
+		Upholds:      make(map[string]*daemon),
+		UpheldBy:     make(map[string]*daemon),
+		Conflicts:    make(map[string]*daemon),
+		ConflictedBy: make(map[string]*daemon),
+		Before:       make(map[string]*daemon),
+		After:        make(map[string]*daemon),
+		OnFailure:    make(map[string]*daemon),
+		OnSuccess:    make(map[string]*daemon),
+		OnFailureOf:  make(map[string]*daemon),
+		OnSuccessOf:  make(map[string]*daemon),
+		// propagation
+		PropagatesReloadTo:   make(map[string]*daemon),
+		ReloadPropagatedFrom: make(map[string]*daemon),
+		PropagatesStopTo:     make(map[string]*daemon),
+		StopPropagatedFrom:   make(map[string]*daemon),
+		GuessMainPID:         true,
+		// -1 propagates the exit status of the main process
+		FailureActionExitStatus: -1,
+		SuccessActionExitStatus: -1,
+		StartLimitInterval:      defaultStartLimitInterval,
+		StartLimitBurst:         defaultStartLimitBurst,
+	}
+}
+
+// loadUnitFile parses a unit file or drop-in following systemd.syntax(7), merging the settings into the daemon definition;
+// diagnostics are logged and recorded against the unit, syntax errors mark the unit as bad-setting, read errors are returned
+func loadUnitFile(d *daemon, r io.Reader, fname string) error {
 	if d == nil || r == nil {
 		return errors.New("nil value provided")
 	}
 	d.Lock()
 	defer d.Unlock()
 	if d.def == nil {
-		d.def = &daemondef{
-			Wants:        make(map[string]*daemon),
-			WantedBy:     make(map[string]*daemon),
-			Requires:     make(map[string]*daemon),
-			RequiredBy:   make(map[string]*daemon),
-			Requisite:    make(map[string]*daemon),
-			RequisiteOf:  make(map[string]*daemon),
-			BindsTo:      make(map[string]*daemon),
-			BoundBy:      make(map[string]*daemon),
-			PartOf:       make(map[string]*daemon),
-			ConsistsOf:   make(map[string]*daemon),
-			Upholds:      make(map[string]*daemon),
-			UpheldBy:     make(map[string]*daemon),
-			Conflicts:    make(map[string]*daemon),
-			ConflictedBy: make(map[string]*daemon),
-			Before:       make(map[string]*daemon),
-			After:        make(map[string]*daemon),
-			OnFailure:    make(map[string]*daemon),
-			OnSuccess:    make(map[string]*daemon),
-		}
-	}
-	section := sectionNone
+		d.def = newDaemonDef()
+	}
+	p := &unitParser{
+		d:     d,
+		fname: fname,
+	}
 	concat := ""
+	continuing := false
+	lineNo := 0
 	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 65536), 1024*1024)
 	for s.Scan() {
-		line := s.Text()
-		trimmedLine := strings.Trim(line, "\r\n\t ")
+		lineNo++
+		trimmedLine := strings.TrimSpace(s.Text())
 		if strings.HasPrefix(trimmedLine, ";") || strings.HasPrefix(trimmedLine, "#") {
+			// comments are also permitted, and ignored, in the middle of a continuation
 			continue
 		}
+		if !continuing {
+			if trimmedLine == "" {
+				continue
+			}
+			p.lineNo = lineNo
+		}
 		if strings.HasSuffix(trimmedLine, "\\") {
-			concat += strings.TrimSuffix(strings.TrimRight(line, " \r\n\t"), "\\") + " "
+			continuing = true
+			concat += strings.TrimSuffix(trimmedLine, "\\") + " "
 			continue
 		}
-		if concat != "" {
-			line = concat + strings.TrimSuffix(strings.TrimRight(line, " \r\n\t"), "\\")
+		if continuing {
+			trimmedLine = strings.TrimSpace(concat + trimmedLine)
 			concat = ""
-			trimmedLine = strings.Trim(line, "\r\n\t ")
-		}
-		nextLine := true
-		switch strings.ToUpper(trimmedLine) {
-		case "[UNIT]":
-			section = sectionUnit
-		case "[SERVICE]":
-			section = sectionService
-		case "[INSTALL]":
-			section = sectionInstall
+			continuing = false
+		}
+		p.parseLine(trimmedLine)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if continuing {
+		p.parseLine(strings.TrimSpace(concat))
+	}
+	if p.bad {
+		d.loadState = LoadStateBadSetting
+	}
+	return nil
+}
+
+func (p *unitParser) parseLine(line string) {
+	if strings.HasPrefix(line, "[") {
+		if !strings.HasSuffix(line, "]") || len(line) < 3 {
+			p.warn("Invalid section header '%s'", line)
+			p.bad = true
+			p.section = ""
+			return
+		}
+		p.section = line[1 : len(line)-1]
+		switch strings.ToUpper(p.section) {
+		case "UNIT", "SERVICE", "INSTALL":
 		default:
-			if strings.HasPrefix(trimmedLine, "[") && strings.HasSuffix(trimmedLine, "]") {
-				section = sectionUnknown
-			} else {
-				nextLine = false
+			if !strings.HasPrefix(p.section, "X-") {
+				p.warn("Unknown section '%s'. Ignoring.", p.section)
+			}
+		}
+		return
+	}
+	if p.section == "" {
+		p.warn("Assignment outside of section. Ignoring.")
+		return
+	}
+	key, val, ok := strings.Cut(line, "=")
+	if !ok {
+		p.warn("Missing '=', ignoring line.")
+		return
+	}
+	key = strings.TrimSpace(key)
+	val = strings.TrimSpace(val)
+	name := strings.ToUpper(key)
+	known := false
+	switch strings.ToUpper(p.section) {
+	case "UNIT":
+		known = p.parseUnitSection(name, val)
+	case "SERVICE":
+		known = p.parseServiceSection(name, val)
+	case "INSTALL":
+		known = p.parseInstallSection(name, val)
+	default:
+		// unknown and X- sections are ignored
+		return
+	}
+	if !known {
+		if inslice.HasString(unsupportedKeys, name) {
+			return
+		}
+		p.warn("Unknown key name '%s' in section '%s', ignoring.", key, p.section)
+	}
+}
+
+func (p *unitParser) parseUnitSection(name string, val string) bool {
+	d := p.d
+	switch name {
+	case "DESCRIPTION":
+		d.def.Description = p.specifiers(val)
+	case "WANTS": // attempt to start, don't fail if dependency fails
+		p.setDeps(d.def.Wants, val)
+	case "WANTEDBY": // opposite of wants
+		p.setDeps(d.def.WantedBy, val)
+	case "REQUIRES": // attempt to start, fail if dependency fails
+		p.setDeps(d.def.Requires, val)
+	case "REQUIREDBY": // opposite of requires
+		p.setDeps(d.def.RequiredBy, val)
+	case "REQUISITE": // if dependency not running, fail, do not attempt to start
+		p.setDeps(d.def.Requisite, val)
+	case "REQUISITEOF":
+		p.setDeps(d.def.RequisiteOf, val)
+	case "BINDSTO": // like requires, but if dependency stops, stop this too
+		p.setDeps(d.def.BindsTo, val)
+	case "BOUNDBY":
+		p.setDeps(d.def.BoundBy, val)
+	case "PARTOF": // not start, but if dependencies are stopped or restarted, this one will too
+		p.setDeps(d.def.PartOf, val)
+	case "CONSISTSOF":
+		p.setDeps(d.def.ConsistsOf, val)
+	case "UPHOLDS": // like wants, but also if the depdendencies are stopped, starts them again (monitoring-like)
+		p.setDeps(d.def.Upholds, val)
+	case "UPHELDBY":
+		p.setDeps(d.def.UpheldBy, val)
+	case "CONFLICTS": // if configured, will stop another service if this one is started
+		p.setDeps(d.def.Conflicts, val)
+	case "CONFLICTEDBY":
+		p.setDeps(d.def.ConflictedBy, val)
+	case "BEFORE": // start before another unit, stop after
+		p.setDeps(d.def.Before, val)
+	case "AFTER": // start after another unit, stop before
+		p.setDeps(d.def.After, val)
+	case "ONFAILURE": // what to start when the service fails (ret!=0)
+		p.setDeps(d.def.OnFailure, val)
+	case "ONSUCCESS": // what to start when the service exits with ret==0
+		p.setDeps(d.def.OnSuccess, val)
+	case "PROPAGATESRELOADTO": // reloading this unit reloads the listed units too
+		p.setDeps(d.def.PropagatesReloadTo, val)
+	case "RELOADPROPAGATEDFROM": // reloading the listed units reloads this unit too
+		p.setDeps(d.def.ReloadPropagatedFrom, val)
+	case "PROPAGATESSTOPTO": // stopping this unit stops the listed units too
+		p.setDeps(d.def.PropagatesStopTo, val)
+	case "STOPPROPAGATEDFROM": // stopping the listed units stops this unit too
+		p.setDeps(d.def.StopPropagatedFrom, val)
+	case "ONFAILUREJOBMODE": // job mode for starting the OnFailure= units
+		p.setJobMode(&d.def.OnFailureJobMode, name, val)
+	case "ONSUCCESSJOBMODE": // job mode for starting the OnSuccess= units
+		p.setJobMode(&d.def.OnSuccessJobMode, name, val)
+	case "STOPWHENUNNEEDED": // if started not manually but as a dependency, if not longer needed, stop it
+		p.setBool(&d.def.StopWhenUnneeded, name, val)
+	case "FAILUREACTION": //none, reboot, reboot-force, reboot-immediate, poweroff, poweroff-force, poweroff-immediate, exit, exit-force, soft-reboot, soft-reboot-force, kexec, kexec-force, halt, halt-force and halt-immediate
+		p.setAction(&d.def.FailureAction, name, val)
+	case "SUCCESSACTION": //none, reboot, reboot-force, reboot-immediate, poweroff, poweroff-force, poweroff-immediate, exit, exit-force, soft-reboot, soft-reboot-force, kexec, kexec-force, halt, halt-force and halt-immediate
+		p.setAction(&d.def.SuccessAction, name, val)
+	case "FAILUREACTIONEXITSTATUS": // exit status for FailureAction=exit, default is the exit status of the main process
+		p.setExitStatus(&d.def.FailureActionExitStatus, name, val)
+	case "SUCCESSACTIONEXITSTATUS": // exit status for SuccessAction=exit, default is the exit status of the main process
+		p.setExitStatus(&d.def.SuccessActionExitStatus, name, val)
+	case "STARTLIMITINTERVALSEC": // with StartLimitBurst=, how many starts are permitted within the interval; 0 disables the limit
+		p.setStartLimitInterval(&d.def.StartLimitInterval, name, val)
+	case "STARTLIMITBURST":
+		p.setStartLimitBurst(&d.def.StartLimitBurst, name, val)
+	case "STARTLIMITACTION": // action when the start limit is hit, same values as FailureAction=
+		p.setAction(&d.def.StartLimitAction, name, val)
+	case "JOBTIMEOUTSEC": // if starting takes longer, JobTimeoutAction= is carried out
+		p.setDuration(&d.def.JobTimeout, name, val)
+	case "JOBTIMEOUTACTION": // same values as FailureAction=
+		p.setAction(&d.def.JobTimeoutAction, name, val)
+	default:
+		if strings.HasPrefix(name, "CONDITION") || strings.HasPrefix(name, "ASSERT") {
+			return p.setCondition(name, val)
+		}
+		return false
+	}
+	return true
+}
+
+func (p *unitParser) parseInstallSection(name string, val string) bool {
+	d := p.d
+	switch name {
+	case "REQUIREDBY": // opposite of requires
+		p.setDeps(d.def.RequiredBy, val)
+		d.def.Installable = d.def.Installable || val != ""
+	case "WANTEDBY": // opposite of wants
+		p.setDeps(d.def.WantedBy, val)
+		d.def.Installable = d.def.Installable || val != ""
+	case "UPHELDBY": // opposite of upholds
+		p.setDeps(d.def.UpheldBy, val)
+		d.def.Installable = d.def.Installable || val != ""
+	case "ALIAS":
+		p.setWords(&d.def.Alias, val)
+		d.def.Installable = d.def.Installable || val != ""
+	case "ALSO":
+		p.setWords(&d.def.Also, val)
+	case "DEFAULTINSTANCE":
+		d.def.DefaultInstance = p.specifiers(val)
+	default:
+		return false
+	}
+	return true
+}
+
+func (p *unitParser) parseServiceSection(name string, val string) bool {
+	d := p.d
+	switch name {
+	case "TYPE": // simple=foreground,exec=simple,forking=background(needs PID as PIDFile=),oneshot=runs+quits but considered still running,dbus/notify/notify-reload=background,idle=simple
+		if val != "" && !inslice.HasString([]string{"simple", "exec", "forking", "oneshot", "dbus", "notify", "notify-reload", "idle"}, val) {
+			p.warn("Failed to parse service type, ignoring: %s", val)
+			break
+		}
+		d.def.ServiceType = val
+	case "REMAINAFTEREXIT": // considered up if service exits
+		p.setBool(&d.def.RemainAfterExit, name, val)
+	case "PIDFILE": // pidfile for background jobs
+		d.def.PidFile = p.specifiers(val)
+	case "GUESSMAINPID": // without PIDFile=, try to determine the main process of forking services
+		p.setBool(&d.def.GuessMainPID, name, val)
+	case "EXECSTART": // run this to start (oneshot=multiple lines permitted, otherwise 1 line only)
+		p.setExec(&d.def.ExecStart, val)
+	case "EXECSTOP":
+		p.setExec(&d.def.ExecStop, val)
+	case "EXECSTARTPRE":
+		p.setExec(&d.def.ExecStartPre, val)
+	case "EXECSTARTPOST":
+		p.setExec(&d.def.ExecStartPost, val)
+	case "EXECSTOPPRE":
+		p.setExec(&d.def.ExecStopPre, val)
+	case "EXECSTOPPOST":
+		p.setExec(&d.def.ExecStopPost, val)
+	case "EXECCONDITION": // before pre, if ret!=0, just don't start (success), otherwise continue
+		p.setExec(&d.def.ExecCondition, val)
+	case "EXECRELOAD": // run on reload, without it the processes of the unit are sent SIGHUP
+		p.setExec(&d.def.ExecReload, val)
+	case "RESTARTSEC": // sleep between restarts Takes a unit-less value in seconds, or a time span value such as "5min 20s". Defaults to 100ms.
+		p.setDuration(&d.def.RestartSleep, name, val)
+	case "TIMEOUTSEC": // sets both TimeoutStartSec= and TimeoutStopSec=
+		t := time.Duration(-1)
+		if p.setDuration(&t, name, val); t >= 0 {
+			d.def.StartTimeout = t
+			d.def.StopTimeout = t
+		}
+	case "STARTLIMITINTERVAL": // deprecated [Service] alias of StartLimitIntervalSec=
+		p.setStartLimitInterval(&d.def.StartLimitInterval, name, val)
+	case "STARTLIMITBURST":
+		p.setStartLimitBurst(&d.def.StartLimitBurst, name, val)
+	case "TIMEOUTSTARTSEC": // how long to wait for a forking service to write its PIDFile=, or 'infinity'
+		p.setDuration(&d.def.StartTimeout, name, val)
+	case "TIMEOUTSTOPSEC": // SIGTERM->SIGKILL timeout, or 'infinity'
+		p.setDuration(&d.def.StopTimeout, name, val)
+	case "RESTART": // no, on-success, (on-failure, on-abnormal, on-watchdog, on-abort), or always
+		if val != "" && !inslice.HasString([]string{"no", "on-success", "on-failure", "on-abnormal", "on-watchdog", "on-abort", "always"}, val) {
+			p.warn("Failed to parse service restart specifier, ignoring: %s", val)
+			break
+		}
+		d.def.Restart = val
+	case "WORKINGDIRECTORY":
+		d.def.WorkingDirectory = p.specifiers(val)
+	case "USER":
+		d.def.User = p.specifiers(val)
+	case "GROUP":
+		d.def.Group = p.specifiers(val)
+	case "LIMITCPU": // ulimit -t
+		d.def.LimitCpu = val
+	case "LIMITFSIZE": // ulimit -f
+		d.def.LimitFsize = val
+	case "LIMITDATA": // ulimit -d
+		d.def.LimitData = val
+	case "LIMITSTACK": // ulimit -s
+		d.def.LimitStack = val
+	case "LIMITCORE": // ulimit -c
+		d.def.LimitCore = val
+	case "LIMITRSS": // ulimit -m
+		d.def.LimitRss = val
+	case "LIMITNOFILE": // ulimit -n
+		d.def.LimitNoFile = val
+	case "LIMITAS": // ulimit -v
+		d.def.LimitAs = val
+	case "LIMITNPROC": // ulimit -u
+		d.def.LimitNProc = val
+	case "LIMITMEMLOCK": // ulimit -l
+		d.def.LimitMemLock = val
+	case "LIMITLOCKS": // ulimit -x
+		d.def.LimitLocks = val
+	case "LIMITSIGPENDING": // ulimit -i
+		d.def.LimitSigPending = val
+	case "LIMITMSGQUEUE": // ulimit -q
+		d.def.LimitMsgQueue = val
+	case "LIMITNICE": // ulimit -e
+		d.def.LimitNice = val
+	case "LIMITRTPRIO": // ulimit -r
+		d.def.LimitRtPrio = val
+	case "LIMITRTTIME": // ulimit -R
+		d.def.LimitRtTime = val
+	case "ENVIRONMENT": // one or more space-separated, optionally quoted, KEY=VALUE assignments
+		if val == "" {
+			d.def.Env = nil
+			break
+		}
+		words, err := splitQuoted(val)
+		if err != nil {
+			p.warn("Invalid syntax, ignoring: %s", val)
+			break
+		}
+		for _, w := range words {
+			if !isValidEnvAssignment(w) {
+				p.warn("Invalid environment assignment, ignoring: %s", w)
+				continue
 			}
+			d.def.Env = append(d.def.Env, p.specifiers(w))
+		}
+	case "ENVIRONMENTFILE":
+		if val == "" {
+			d.def.EnvFile = nil
+			break
 		}
-		if nextLine {
+		d.def.EnvFile = append(d.def.EnvFile, p.specifiers(val))
+	case "PASSENVIRONMENT": // variable names to pass from the manager environment
+		p.setWords(&d.def.PassEnv, val)
+	case "UNSETENVIRONMENT": // variable names, or exact KEY=VALUE assignments, to remove from the environment
+		p.setWords(&d.def.UnsetEnv, val)
+	default:
+		return false
+	}
+	return true
+}
+
+// setDeps handles space-separated unit lists; an empty assignment resets the list
+func (p *unitParser) setDeps(item map[string]*daemon, val string) {
+	if val == "" {
+		clear(item)
+		return
+	}
+	words, err := splitQuoted(val)
+	if err != nil {
+		p.warn("Invalid syntax, ignoring: %s", val)
+		return
+	}
+	for _, v := range words {
+		// services are tracked without the .service suffix, other unit types keep theirs
+		item[strings.TrimSuffix(p.specifiers(v), ".service")] = nil
+	}
+}
+
+// setWords appends space-separated, optionally quoted, words to the list; an empty assignment resets the list
+func (p *unitParser) setWords(item *[]string, val string) {
+	if val == "" {
+		*item = nil
+		return
+	}
+	words, err := splitQuoted(val)
+	if err != nil {
+		p.warn("Invalid syntax, ignoring: %s", val)
+		return
+	}
+	for _, w := range words {
+		*item = append(*item, p.specifiers(w))
+	}
+}
+
+// setExec appends a command line to the list; an empty assignment resets the list
+func (p *unitParser) setExec(item *[]string, val string) {
+	if val == "" {
+		*item = nil
+		return
+	}
+	*item = append(*item, p.specifiers(val))
+}
+
+func (p *unitParser) setBool(item *bool, name string, val string) {
+	b, err := parseBoolean(val)
+	if err != nil {
+		p.warn("Failed to parse boolean value for %s=, ignoring: %s", name, val)
+		return
+	}
+	*item = b
+}
+
+// unitActions are the values accepted by FailureAction=, SuccessAction=, StartLimitAction= and JobTimeoutAction=
+var unitActions = []string{"none", "reboot", "reboot-force", "reboot-immediate", "poweroff", "poweroff-force", "poweroff-immediate",
+	"exit", "exit-force", "soft-reboot", "soft-reboot-force", "kexec", "kexec-force", "halt", "halt-force", "halt-immediate"}
+
+func (p *unitParser) setAction(item *string, name string, val string) {
+	if val != "" && !inslice.HasString(unitActions, val) {
+		p.warn("Failed to parse %s=, ignoring: %s", name, val)
+		return
+	}
+	*item = val
+}
+
+// jobModes are the accepted values of OnFailureJobMode= and OnSuccessJobMode=
+var jobModes = []string{"fail", "replace", "replace-irreversibly", "isolate", "flush", "ignore-dependencies", "ignore-requirements"}
+
+func (p *unitParser) setJobMode(item *string, name string, val string) {
+	if val != "" && !inslice.HasString(jobModes, val) {
+		p.warn("Failed to parse %s=, ignoring: %s", name, val)
+		return
+	}
+	*item = val
+}
+
+func (p *unitParser) setExitStatus(item *int, name string, val string) {
+	if val == "" {
+		*item = -1
+		return
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 0 || n > 255 {
+		p.warn("Failed to parse %s=, ignoring: %s", name, val)
+		return
+	}
+	*item = n
+}
+
+// setStartLimitInterval and setStartLimitBurst restore the default start limit on an empty value, unlike setDuration and
+// setInt, so that an explicit 0 stays distinguishable and disables the limit
+func (p *unitParser) setStartLimitInterval(item *time.Duration, name string, val string) {
+	if val == "" {
+		*item = defaultStartLimitInterval
+		return
+	}
+	p.setDuration(item, name, val)
+}
+
+func (p *unitParser) setStartLimitBurst(item *int, name string, val string) {
+	if val == "" {
+		*item = defaultStartLimitBurst
+		return
+	}
+	p.setInt(item, name, val)
+}
+
+func (p *unitParser) setInt(item *int, name string, val string) {
+	if val == "" {
+		*item = 0
+		return
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 0 {
+		p.warn("Failed to parse %s=, ignoring: %s", name, val)
+		return
+	}
+	*item = n
+}
+
+func (p *unitParser) setDuration(item *time.Duration, name string, val string) {
+	if val == "" {
+		*item = 0
+		return
+	}
+	if val == "infinity" {
+		*item = infinity
+		return
+	}
+	dur, err := parseSystemdDuration(val)
+	if err != nil {
+		p.warn("Failed to parse time span for %s=, ignoring: %s", name, val)
+		return
+	}
+	*item = dur
+}
+
+// specifiers expands the %-specifiers based on the unit name: %i/%I instance, %n/%N full name, %p/%P prefix and %%
+func (p *unitParser) specifiers(val string) string {
+	if !strings.Contains(val, "%") {
+		return val
+	}
+	prefix, inst, _ := strings.Cut(p.d.name, "@")
+	out := strings.Builder{}
+	for i := 0; i < len(val); i++ {
+		if val[i] != '%' || i == len(val)-1 {
+			out.WriteByte(val[i])
 			continue
 		}
-		name, val := parseUnitLine(line)
-		switch section {
-		case sectionUnit:
-			switch name {
-			case "DESCRIPTION":
-				d.def.Description = val
-			case "WANTS": // attempt to start, don't fail if dependency fails
-				item := d.def.Wants
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "WANTEDBY": // opposite of wants
-				item := d.def.WantedBy
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "REQUIRES": // attempt to start, fail if dependency fails
-				item := d.def.Requires
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "REQUIREDBY": // opposite of requires
-				item := d.def.RequiredBy
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "REQUISITE": // if dependency not running, fail, do not attempt to start
-				item := d.def.Requisite
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "REQUISITEOF":
-				item := d.def.RequisiteOf
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "BINDSTO": // like requires, but if dependency stops, stop this too
-				item := d.def.BindsTo
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "BOUNDBY":
-				item := d.def.BoundBy
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "PARTOF": // not start, but if dependencies are stopped or restarted, this one will too
-				item := d.def.PartOf
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "CONSISTSOF":
-				item := d.def.ConsistsOf
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "UPHOLDS": // like wants, but also if the depdendencies are stopped, starts them again (monitoring-like)
-				item := d.def.Upholds
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "UPHELDBY":
-				item := d.def.UpheldBy
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "CONFLICTS": // if configured, will stop another service if this one is started
-				item := d.def.Conflicts
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "CONFLICTEDBY":
-				item := d.def.ConflictedBy
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "BEFORE": // start before another unit, stop after
-				item := d.def.Before
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "AFTER": // start after another unit, stop before
-				item := d.def.After
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "ONFAILURE": // what to start when the service fails (ret!=0)
-				item := d.def.OnFailure
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "ONSUCCESS": // what to start when the service exits with ret==0
-				item := d.def.OnSuccess
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "STOPWHENUNNEEDED": // if started not manually but as a dependency, if not longer needed, stop it
-				if strings.ToLower(val) == "true" {
-					d.def.StopWhenUnneeded = true
-				} else {
-					d.def.StopWhenUnneeded = false
-				}
-			case "FAILUREACTION": //none, reboot, reboot-force, reboot-immediate, poweroff, poweroff-force, poweroff-immediate, exit, exit-force, soft-reboot, soft-reboot-force, kexec, kexec-force, halt, halt-force and halt-immediate
-				d.def.FailureAction = val
-			case "SUCCESSACTION": //none, reboot, reboot-force, reboot-immediate, poweroff, poweroff-force, poweroff-immediate, exit, exit-force, soft-reboot, soft-reboot-force, kexec, kexec-force, halt, halt-force and halt-immediate
-				d.def.SuccessAction = val
+		i++
+		switch val[i] {
+		case 'i', 'I':
+			out.WriteString(inst)
+		case 'n':
+			out.WriteString(p.d.name + ".service")
+		case 'N':
+			out.WriteString(p.d.name)
+		case 'p', 'P':
+			out.WriteString(prefix)
+		case '%':
+			out.WriteByte('%')
+		default:
+			out.WriteByte('%')
+			out.WriteByte(val[i])
+		}
+	}
+	return out.String()
+}
+
+// parseBoolean accepts the systemd boolean values: 1/yes/y/true/t/on and 0/no/n/false/f/off
+func parseBoolean(val string) (bool, error) {
+	switch strings.ToLower(val) {
+	case "1", "yes", "y", "true", "t", "on":
+		return true, nil
+	case "0", "no", "n", "false", "f", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean value %q", val)
+}
+
+// isValidEnvAssignment checks that a string is a KEY=VALUE pair with a valid variable name
+func isValidEnvAssignment(s string) bool {
+	k, _, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return false
+	}
+	for i, r := range k {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
 
+// splitQuoted splits a value into words on whitespace, honouring double and single quotes and C-style escapes
+func splitQuoted(s string) ([]string, error) {
+	words := []string{}
+	word := strings.Builder{}
+	inWord := false
+	quote := byte(0)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\':
+			if i == len(s)-1 {
+				return nil, errors.New("trailing backslash")
 			}
-		case sectionInstall:
-			switch name {
-			case "REQUIREDBY": // opposite of requires
-				item := d.def.RequiredBy
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "WANTEDBY": // opposite of wants
-				item := d.def.WantedBy
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
-			case "UPHELDBY": // opposite of upholds
-				item := d.def.UpheldBy
-				if val == "" {
-					for k := range item {
-						delete(item, k)
-					}
-				} else {
-					for _, v := range strings.Split(val, " ") {
-						item[v] = nil
-					}
-				}
+			n, r, err := unescape(s[i+1:])
+			if err != nil {
+				return nil, err
 			}
-		case sectionService:
-			switch name {
-			case "TYPE": // simple=foreground,exec=simple,forking=background(needs PID as PIDFile=),oneshot=runs+quits but considered still running,dbus/notify/notify-reload=background,idle=simple
-				d.def.ServiceType = val
-			case "REMAINAFTEREXIT": // considered up if service exits
-				if strings.ToLower(val) == "true" {
-					d.def.RemainAfterExit = true
-				} else {
-					d.def.RemainAfterExit = false
-				}
-			case "PIDFILE": // pidfile for background jobs
-				d.def.PidFile = val
-			case "EXECSTART": // run this to start (oneshot=multiple lines permitted, otherwise 1 line only)
-				if strings.Contains(d.name, "@") {
-					valInst := strings.Split(d.name, "@")[1]
-					val = strings.ReplaceAll(strings.ReplaceAll(val, "%i", valInst), "%I", valInst)
-				}
-				d.def.ExecStart = append(d.def.ExecStart, val)
-			case "EXECSTOP":
-				if strings.Contains(d.name, "@") {
-					valInst := strings.Split(d.name, "@")[1]
-					val = strings.ReplaceAll(strings.ReplaceAll(val, "%i", valInst), "%I", valInst)
-				}
-				d.def.ExecStop = append(d.def.ExecStop, val)
-			case "EXECSTARTPRE":
-				if strings.Contains(d.name, "@") {
-					valInst := strings.Split(d.name, "@")[1]
-					val = strings.ReplaceAll(strings.ReplaceAll(val, "%i", valInst), "%I", valInst)
-				}
-				d.def.ExecStartPre = append(d.def.ExecStartPre, val)
-			case "EXECSTARTPOST":
-				if strings.Contains(d.name, "@") {
-					valInst := strings.Split(d.name, "@")[1]
-					val = strings.ReplaceAll(strings.ReplaceAll(val, "%i", valInst), "%I", valInst)
-				}
-				d.def.ExecStartPost = append(d.def.ExecStartPost, val)
-			case "EXECSTOPPRE":
-				if strings.Contains(d.name, "@") {
-					valInst := strings.Split(d.name, "@")[1]
-					val = strings.ReplaceAll(strings.ReplaceAll(val, "%i", valInst), "%I", valInst)
-				}
-				d.def.ExecStopPre = append(d.def.ExecStopPre, val)
-			case "EXECSTOPPOST":
-				if strings.Contains(d.name, "@") {
-					valInst := strings.Split(d.name, "@")[1]
-					val = strings.ReplaceAll(strings.ReplaceAll(val, "%i", valInst), "%I", valInst)
-				}
-				d.def.ExecStopPost = append(d.def.ExecStopPost, val)
-			case "EXECCONDITION": // before pre, if ret!=0, just don't start (success), otherwise continue
-				if strings.Contains(d.name, "@") {
-					valInst := strings.Split(d.name, "@")[1]
-					val = strings.ReplaceAll(strings.ReplaceAll(val, "%i", valInst), "%I", valInst)
-				}
-				d.def.ExecCondition = append(d.def.ExecCondition, val)
-			case "EXECRELOAD": // call on daemon-reload
-				if strings.Contains(d.name, "@") {
-					valInst := strings.Split(d.name, "@")[1]
-					val = strings.ReplaceAll(strings.ReplaceAll(val, "%i", valInst), "%I", valInst)
-				}
-				d.def.ExecReload = val
-			case "RESTARTSEC": // sleep between restarts Takes a unit-less value in seconds, or a time span value such as "5min 20s". Defaults to 100ms.
-				var err error
-				d.def.RestartSleep, err = parseSystemdDuration(val)
-				if err != nil {
-					return err
-				}
-			case "TIMEOUTSEC":
-				fallthrough
-			case "TIMEOUTSTOPSEC": // SIGTERM->SIGKILL timeout, or 'infinity'
-				var err error
-				d.def.StopTimeout, err = parseSystemdDuration(val)
-				if err != nil {
-					return err
-				}
-			case "RESTART": // no, on-success, (on-failure, on-abnormal, on-watchdog, on-abort), or always
-				d.def.Restart = val
-			case "WORKINGDIRECTORY":
-				d.def.WorkingDirectory = val
-			case "USER":
-				d.def.User = val
-			case "GROUP":
-				d.def.Group = val
-			case "LIMITCPU": // ulimit -t
-				d.def.LimitCpu = val
-			case "LIMITFSIZE": // ulimit -f
-				d.def.LimitFsize = val
-			case "LIMITDATA": // ulimit -d
-				d.def.LimitData = val
-			case "LIMITSTACK": // ulimit -s
-				d.def.LimitStack = val
-			case "LIMITCORE": // ulimit -c
-				d.def.LimitCore = val
-			case "LIMITRSS": // ulimit -m
-				d.def.LimitRss = val
-			case "LIMITNOFILE": // ulimit -n
-				d.def.LimitNoFile = val
-			case "LIMITAS": // ulimit -v
-				d.def.LimitAs = val
-			case "LIMITNPROC": // ulimit -u
-				d.def.LimitNProc = val
-			case "LIMITMEMLOCK": // ulimit -l
-				d.def.LimitMemLock = val
-			case "LIMITLOCKS": // ulimit -x
-				d.def.LimitLocks = val
-			case "LIMITSIGPENDING": // ulimit -i
-				d.def.LimitSigPending = val
-			case "LIMITMSGQUEUE": // ulimit -q
-				d.def.LimitMsgQueue = val
-			case "LIMITNICE": // ulimit -e
-				d.def.LimitNice = val
-			case "LIMITRTPRIO": // ulimit -r
-				d.def.LimitRtPrio = val
-			case "LIMITRTTIME": // ulimit -R
-				d.def.LimitRtTime = val
-			case "ENVIRONMENT":
-				d.def.Env = append(d.def.Env, val)
-			case "ENVIRONMENTFILE":
-				d.def.EnvFile = append(d.def.EnvFile, val)
+			word.WriteString(r)
+			i += n
+			inWord = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
 			}
+		default:
+			word.WriteByte(c)
+			inWord = true
 		}
 	}
-	return nil
+	if quote != 0 {
+		return nil, errors.New("unbalanced quotes")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
 }
 
-func parseUnitLine(line string) (name string, val string) {
-	split := strings.Split(line, "=")
-	name = strings.ToUpper(strings.Trim(split[0], "\r\n\t "))
-	if len(split) == 1 {
-		return
+// unescape decodes a single C-style escape sequence (without the leading backslash), returning the number of bytes consumed
+func unescape(s string) (int, string, error) {
+	switch s[0] {
+	case 'a':
+		return 1, "\a", nil
+	case 'b':
+		return 1, "\b", nil
+	case 'f':
+		return 1, "\f", nil
+	case 'n':
+		return 1, "\n", nil
+	case 'r':
+		return 1, "\r", nil
+	case 't':
+		return 1, "\t", nil
+	case 'v':
+		return 1, "\v", nil
+	case 's':
+		return 1, " ", nil
+	case '\\', '"', '\'', ' ':
+		return 1, string(s[0]), nil
+	case 'x':
+		if len(s) < 3 {
+			return 0, "", errors.New("invalid escape")
+		}
+		v, err := strconv.ParseUint(s[1:3], 16, 8)
+		if err != nil {
+			return 0, "", errors.New("invalid escape")
+		}
+		return 3, string([]byte{byte(v)}), nil
+	case 'u', 'U':
+		n := 4
+		if s[0] == 'U' {
+			n = 8
+		}
+		if len(s) < n+1 {
+			return 0, "", errors.New("invalid escape")
+		}
+		v, err := strconv.ParseUint(s[1:n+1], 16, 32)
+		if err != nil {
+			return 0, "", errors.New("invalid escape")
+		}
+		return n + 1, string(rune(v)), nil
+	case '0', '1', '2', '3', '4', '5', '6', '7':
+		if len(s) < 3 {
+			return 0, "", errors.New("invalid escape")
+		}
+		v, err := strconv.ParseUint(s[0:3], 8, 8)
+		if err != nil {
+			return 0, "", errors.New("invalid escape")
+		}
+		return 3, string([]byte{byte(v)}), nil
 	}
-	right := strings.Join(split[1:], "=")
-	tmp := strings.Trim(right, " ")
-	if strings.HasPrefix(tmp, "\"") && strings.HasSuffix(tmp, "\"") {
-		val = strings.Trim(tmp, "\"")
+	return 0, "", fmt.Errorf("invalid escape \\%c", s[0])
+}
+
+// verify checks the fully loaded unit (fragment and drop-ins) for settings which make it unusable, marking it bad-setting
+func (d *daemon) verify() {
+	if d.loadState != LoadStateLoaded || d.def == nil {
 		return
 	}
-	if strings.HasPrefix(tmp, "'") && strings.HasSuffix(tmp, "'") {
-		val = strings.Trim(tmp, "'")
-		return
+	if len(d.def.ExecStart) == 0 && len(d.def.ExecStop) == 0 && d.def.SuccessAction == "" {
+		d.badSetting("Service has no ExecStart=, ExecStop=, or SuccessAction=. Refusing.")
+	} else if len(d.def.ExecStart) == 0 && d.def.ServiceType != "oneshot" {
+		d.badSetting("Service has no ExecStart= setting, which is only allowed for Type=oneshot services. Refusing.")
+	} else if len(d.def.ExecStart) > 1 && d.def.ServiceType != "oneshot" {
+		d.badSetting("Service has more than one ExecStart= setting, which is only allowed for Type=oneshot services. Refusing.")
 	}
-	val = strings.TrimLeft(right, " ")
-	return
+}
+
+func (d *daemon) badSetting(msg string) {
+	msg = d.fragment + ": " + msg
+	log.Printf("<%s> %s", d.name, msg)
+	d.loadMessages = append(d.loadMessages, msg)
+	d.loadState = LoadStateBadSetting
 }
 
 func parseSystemdDuration(s string) (time.Duration, error) {
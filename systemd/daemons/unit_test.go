@@ -0,0 +1,47 @@
+package daemons
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitQuoted(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", in: "", want: []string{}},
+		{name: "whitespace only", in: " \t ", want: []string{}},
+		{name: "words", in: "a.service  b.service\tc", want: []string{"a.service", "b.service", "c"}},
+		{name: "double quotes", in: `"a b" c`, want: []string{"a b", "c"}},
+		{name: "single quotes", in: `'a "b"' c`, want: []string{`a "b"`, "c"}},
+		{name: "quotes join a word", in: `a"b c"d`, want: []string{"ab cd"}},
+		{name: "empty quotes", in: `"" x`, want: []string{"", "x"}},
+		{name: "escaped space", in: `a\ b c`, want: []string{"a b", "c"}},
+		{name: "escape in quotes", in: `"a\"b"`, want: []string{`a"b`}},
+		{name: "C escapes", in: `\t\n\s`, want: []string{"\t\n "}},
+		{name: "hex escape", in: `\x41é`, want: []string{"Aé"}},
+		{name: "unbalanced quotes", in: `"a b`, wantErr: true},
+		{name: "trailing backslash", in: `a\`, wantErr: true},
+		{name: "invalid hex escape", in: `\xZZ`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := splitQuoted(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("splitQuoted(%q) = %q, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("splitQuoted(%q) returned error: %s", tt.in, err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("splitQuoted(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
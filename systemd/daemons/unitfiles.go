@@ -0,0 +1,139 @@
+package daemons
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"docker-systemd/common"
+)
+
+// localUnitPath is where the local configuration written by edit, add-wants and add-requires goes
+var localUnitPath = "/etc/systemd/system"
+
+// Cat returns the unit file and its drop-ins, each preceded by a comment with its path, as systemctl cat prints them
+func (d *daemon) Cat() (string, error) {
+	d.RLock()
+	defer d.RUnlock()
+	if d.isMasked {
+		return fmt.Sprintf("# Unit %s.service is masked.", d.name), nil
+	}
+	files := []string{}
+	if d.fragment != "" {
+		files = append(files, d.fragment)
+	}
+	files = append(files, d.dropins...)
+	if len(files) == 0 {
+		return "", fmt.Errorf("No files found for %s.service.", d.name)
+	}
+	parts := []string{}
+	for _, f := range files {
+		contents, err := os.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, "# "+f+"\n"+strings.TrimRight(string(contents), "\n"))
+	}
+	return strings.Join(parts, "\n\n"), nil
+}
+
+// Revert removes the local configuration of the unit: drop-in directories in /etc and /run, a mask, and a unit file in
+// /etc which overrides a vendor unit file of the same name; returns the paths removed
+func (d *daemon) Revert() ([]string, error) {
+	d.Lock()
+	defer d.Unlock()
+	removed := []string{}
+	for _, dir := range []string{localUnitPath, runtimeUnitPath} {
+		dropIn := path.Join(dir, d.name+".service.d")
+		if _, err := os.Stat(dropIn); err == nil {
+			if err := os.RemoveAll(dropIn); err != nil {
+				return removed, err
+			}
+			removed = append(removed, dropIn)
+		}
+		unitFile := path.Join(dir, d.name+".service")
+		fi, err := os.Lstat(unitFile)
+		if err != nil {
+			continue
+		}
+		if dest, err := os.Readlink(unitFile); err == nil && dest == "/dev/null" {
+			if err := os.Remove(unitFile); err != nil {
+				return removed, err
+			}
+			removed = append(removed, unitFile)
+			d.isMasked = false
+			continue
+		}
+		if fi.Mode().IsRegular() && d.hasVendorFile() {
+			if err := os.Remove(unitFile); err != nil {
+				return removed, err
+			}
+			removed = append(removed, unitFile)
+		}
+	}
+	return removed, nil
+}
+
+// hasVendorFile returns true if a unit file of the same name exists outside of /etc; called with the daemon locked
+func (d *daemon) hasVendorFile() bool {
+	for _, p := range d.paths {
+		if !strings.HasPrefix(p, localUnitPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// AddDependency links the unit into the .wants/ directory of the target, or .requires/ if requires is set, so that
+// the target pulls it in; returns the link created, or an empty string if it already existed
+func (d *daemon) AddDependency(target string, requires bool) (string, error) {
+	d.RLock()
+	defer d.RUnlock()
+	if d.isMasked {
+		return "", fmt.Errorf("Unit %s.service is masked.", d.name)
+	}
+	if d.fragment == "" {
+		return "", errors.New("service path not found")
+	}
+	suffix := ".wants"
+	if requires {
+		suffix = ".requires"
+	}
+	dir := path.Join(localUnitPath, target+suffix)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	link := path.Join(dir, d.name+".service")
+	if _, err := os.Lstat(link); err == nil {
+		return "", nil
+	}
+	return link, os.Symlink(d.fragment, link)
+}
+
+// loadDependencyDirs adds the units linked into the .wants/ and .requires/ directories of the unit to its Wants= and
+// Requires=, same as add-wants and add-requires write them; called with the daemon locked
+func (d *daemon) loadDependencyDirs() {
+	dirs := append(common.GetSystemdPaths(), runtimeUnitPath)
+	for _, dep := range []struct {
+		suffix string
+		item   map[string]*daemon
+	}{
+		{".wants", d.def.Wants},
+		{".requires", d.def.Requires},
+	} {
+		for _, dir := range dirs {
+			entries, err := os.ReadDir(path.Join(dir, d.name+".service"+dep.suffix))
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				if entry.IsDir() {
+					continue
+				}
+				dep.item[strings.TrimSuffix(entry.Name(), ".service")] = nil
+			}
+		}
+	}
+}
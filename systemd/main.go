@@ -119,6 +119,8 @@ func Main() {
 		}
 	}
 	os.MkdirAll(common.GetLogPath(), 0755)
+	// sd_booted() checks for this directory to detect that systemd is the init system
+	os.MkdirAll("/run/systemd/system", 0755)
 	forkfile := amdforkfile
 	fakeforkfile := amdfakeforkfile
 	if runtime.GOARCH == "arm64" {
@@ -147,6 +149,9 @@ func Main() {
 		<-c
 		shutdown(socket)
 	}()
+	daemons.ManagerAction = func(ds daemons.Daemons, action string, exitStatus int) {
+		managerAction(socket, ds, action, exitStatus)
+	}
 	log.Println("INIT: Starting services")
 	go func() {
 		err = startup()
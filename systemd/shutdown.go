@@ -3,30 +3,107 @@ package systemd
 import (
 	"docker-systemd/common"
 	"docker-systemd/procwait"
+	"docker-systemd/systemd/daemons"
 	"log"
 	"net"
 	"os"
 	"sync"
+	"syscall"
+	"time"
 )
 
 var shutdownLock = new(sync.Mutex)
 
 func shutdown(socket net.Listener) {
-	shutdownLock.Lock()
 	log.Println("SHUTDOWN: Signal received")
+	exit(socket, nil, 0, false)
+}
+
+// exit stops all services, or with force kills all processes, then reaps and exits with the given status
+func exit(socket net.Listener, ds daemons.Daemons, status int, force bool) {
+	shutdownLock.Lock()
 	socket.Close()
 	os.Remove(common.SocketPath())
-	log.Println("SHUTDOWN: Stopping services")
-	// StopAll() will set the shutdown flag internally
-	err := d.StopAll()
-	if err != nil {
-		log.Printf("SHUTDOWN: Error, unclean exit: %s, reaping processes", err)
-		procwait.FinalReap()
-		log.Println("SHUTDOWN: Reaped processes, exiting with error")
-		os.Exit(1)
+	if ds == nil {
+		ds = getDaemons()
+	}
+	if force {
+		log.Println("SHUTDOWN: Killing all processes")
+		if ds != nil {
+			ds.KillAll(syscall.SIGKILL)
+		}
+		if os.Getpid() == 1 {
+			syscall.Kill(-1, syscall.SIGKILL)
+		}
+	} else if ds != nil {
+		log.Println("SHUTDOWN: Stopping services")
+		// StopAll() will set the shutdown flag internally
+		err := ds.StopAll()
+		if err != nil {
+			log.Printf("SHUTDOWN: Error, unclean exit: %s, reaping processes", err)
+			procwait.FinalReap()
+			log.Println("SHUTDOWN: Reaped processes, exiting with error")
+			os.Exit(1)
+		}
 	}
 	log.Println("SHUTDOWN: Reaping processes")
 	procwait.FinalReap()
-	log.Println("SHUTDOWN: Complete")
-	os.Exit(0)
+	log.Printf("SHUTDOWN: Complete, exit status %d", status)
+	os.Exit(status)
+}
+
+// softReboot stops all services, or with force kills them, reaps all processes and starts the services again with a
+// new boot ID; the manager process and the control socket remain in place
+func softReboot(ds daemons.Daemons, force bool) {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+	if ds == nil {
+		ds = getDaemons()
+	}
+	if ds != nil {
+		if force {
+			log.Println("REBOOT: Killing all services")
+			ds.KillAll(syscall.SIGKILL)
+		} else {
+			log.Println("REBOOT: Stopping services")
+			ds.StopAll()
+		}
+	}
+	log.Println("REBOOT: Reaping processes")
+	procwait.FinalReap()
+	bootTime := time.Now()
+	err := common.WriteBootFile(bootTime)
+	if err != nil {
+		log.Printf("REBOOT: Could not write boot file: %s", err)
+	}
+	log.Printf("REBOOT: Starting services, boot time %s", bootTime.Format(time.RFC3339))
+	err = startup()
+	if err != nil {
+		log.Printf("REBOOT: %s", err)
+	}
+	log.Println("REBOOT: Complete")
+}
+
+// managerAction carries out FailureAction=, SuccessAction=, StartLimitAction= and JobTimeoutAction= of units;
+// a container cannot power off, so these exit the container, while the reboot actions perform a soft-reboot
+func managerAction(socket net.Listener, ds daemons.Daemons, action string, exitStatus int) {
+	log.Printf("ACTION: %s", action)
+	switch action {
+	case "exit":
+		exit(socket, ds, exitStatus, false)
+	case "exit-force":
+		exit(socket, ds, exitStatus, true)
+	case "poweroff", "halt":
+		exit(socket, ds, 0, false)
+	case "poweroff-force", "halt-force":
+		exit(socket, ds, 0, true)
+	case "poweroff-immediate", "halt-immediate":
+		os.Exit(0)
+	case "reboot", "soft-reboot", "kexec":
+		softReboot(ds, false)
+	case "reboot-force", "soft-reboot-force", "kexec-force", "reboot-immediate":
+		softReboot(ds, true)
+	default:
+		log.Printf("ACTION: %s not supported, ignoring", action)
+	}
 }
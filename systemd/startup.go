@@ -1,11 +1,31 @@
 package systemd
 
-import "docker-systemd/systemd/daemons"
+import (
+	"sync"
 
-var d daemons.Daemons
+	"docker-systemd/systemd/daemons"
+)
+
+// registry holds the units; soft-reboot replaces it while commands are served, so it is read with getDaemons
+var (
+	registry     daemons.Daemons
+	registryLock sync.RWMutex
+)
+
+// Version is the docker-systemd release, shown by systemctl show
+var Version string
+
+// getDaemons returns the current registry of units, or nil while the system is still booting
+func getDaemons() daemons.Daemons {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return registry
+}
 
 func startup() error {
-	var err error
-	d, err = daemons.New()
+	ds, err := daemons.New()
+	registryLock.Lock()
+	registry = ds
+	registryLock.Unlock()
 	return err
 }